@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/blevesearch/bleve"
+	blevequery "github.com/blevesearch/bleve/search/query"
+)
+
+// the group every page open to everyone is indexed with - a page may also
+//  say Access: * to be open to everyone
+const everyone = "*"
+
+// the realm given in basic auth prompts when none is configured
+const defaultRealm = "goki"
+
+// User is someone making a request, and the groups they are in. A user
+//  without a Name did not log in.
+type User struct {
+	Name   string
+	Groups []string
+}
+
+// Authenticator identifies the user making a request
+type Authenticator interface {
+	// Authenticate gives the user that made the request - one without a Name
+	//  if the request did not log in, or did so with bad credentials
+	Authenticate(r *http.Request) User
+	// Challenge answers a request that has to log in to see a page
+	Challenge(w http.ResponseWriter)
+}
+
+// NewAuthenticator sets up the Authenticator an AuthSection asks for
+func NewAuthenticator(c AuthSection) (Authenticator, error) {
+	switch c.Type {
+	case "":
+		return anonymousAuth{}, nil
+	case "htpasswd":
+		return newHtpasswdAuth(c)
+	case "proxy":
+		return newProxyAuth(c)
+	}
+	return nil, &Error{Code: ErrBadAuthType, value: c.Type}
+}
+
+// anonymousAuth is used when nobody can log in, so pages limited to a group
+//  can not be seen at all
+type anonymousAuth struct{}
+
+func (a anonymousAuth) Authenticate(r *http.Request) User {
+	return User{}
+}
+
+func (a anonymousAuth) Challenge(w http.ResponseWriter) {
+	http.Error(w, "Page not Found", http.StatusNotFound)
+}
+
+// htpasswdAuth checks basic auth against an htpasswd file, with the groups
+//  of each user read from a group file
+type htpasswdAuth struct {
+	users  map[string]string   // user -> password hash
+	groups map[string][]string // user -> groups
+	realm  string
+}
+
+func newHtpasswdAuth(c AuthSection) (*htpasswdAuth, error) {
+	if c.HtpasswdFile == "" {
+		return nil, &Error{Code: ErrBadAuth, path: c.Type, value: "no HtpasswdFile given"}
+	}
+	a := &htpasswdAuth{realm: c.Realm, groups: make(map[string][]string)}
+	if a.realm == "" {
+		a.realm = defaultRealm
+	}
+
+	var err error
+	a.users, err = readHtpasswd(c.HtpasswdFile)
+	if err != nil {
+		return nil, err
+	}
+	if c.GroupFile != "" {
+		a.groups, err = readGroupFile(c.GroupFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+func (a *htpasswdAuth) Authenticate(r *http.Request) User {
+	name, pass, ok := r.BasicAuth()
+	hash, known := a.users[name]
+	if !ok || !known || !checkPassword(hash, pass) {
+		return User{}
+	}
+	return User{Name: name, Groups: a.groups[name]}
+}
+
+func (a *htpasswdAuth) Challenge(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="`+a.realm+`"`)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+// readHtpasswd reads the user:hash lines of an htpasswd file. Only MD5
+//  (htpasswd -m) and SHA1 (htpasswd -s) hashes can be checked, so any other
+//  hash is an error.
+func readHtpasswd(filePath string) (map[string]string, error) {
+	users := make(map[string]string)
+	err := readLines(filePath, func(line string) error {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" ||
+			!(strings.HasPrefix(parts[1], "$apr1$") || strings.HasPrefix(parts[1], "{SHA}")) {
+			return &Error{Code: ErrBadHtpasswd, path: filePath, value: parts[0]}
+		}
+		users[parts[0]] = parts[1]
+		return nil
+	})
+	return users, err
+}
+
+// readGroupFile reads the "group: user user" lines of a group file, and
+//  gives the groups of each user
+func readGroupFile(filePath string) (map[string][]string, error) {
+	groups := make(map[string][]string)
+	err := readLines(filePath, func(line string) error {
+		parts := strings.SplitN(line, ":", 2)
+		group := normalizeTag(parts[0])
+		if len(parts) != 2 || group == "" {
+			return &Error{Code: ErrBadGroupFile, path: filePath, value: line}
+		}
+		for _, user := range strings.Fields(parts[1]) {
+			groups[user] = append(groups[user], group)
+		}
+		return nil
+	})
+	return groups, err
+}
+
+// readLines passes each line of a file to each, skipping blank lines and
+//  lines starting with #
+func readLines(filePath string, each func(string) error) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return &Error{Code: ErrFileRead, value: filePath, innerError: err}
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := each(line); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return &Error{Code: ErrFileRead, value: filePath, innerError: err}
+	}
+	return nil
+}
+
+// checkPassword checks a password against an htpasswd hash
+func checkPassword(hash, password string) bool {
+	var expected string
+	switch {
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt := strings.SplitN(strings.TrimPrefix(hash, "$apr1$"), "$", 2)[0]
+		expected = apr1(password, salt)
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		expected = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(expected)) == 1
+}
+
+// apr1 hashes a password the way htpasswd -m does - Apache's version of the
+//  MD5 crypt
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.Sum([]byte(password + salt + password))
+	ctx := md5.New()
+	ctx.Write([]byte(password + magic + salt))
+	for left := len(pw); left > 0; left -= 16 {
+		if left > 16 {
+			ctx.Write(alt[:])
+		} else {
+			ctx.Write(alt[:left])
+		}
+	}
+	for left := len(pw); left > 0; left >>= 1 {
+		if left&1 == 1 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	final := ctx.Sum(nil)
+
+	for round := 0; round < 1000; round++ {
+		ctx := md5.New()
+		if round&1 == 1 {
+			ctx.Write(pw)
+		} else {
+			ctx.Write(final)
+		}
+		if round%3 != 0 {
+			ctx.Write([]byte(salt))
+		}
+		if round%7 != 0 {
+			ctx.Write(pw)
+		}
+		if round&1 == 1 {
+			ctx.Write(final)
+		} else {
+			ctx.Write(pw)
+		}
+		final = ctx.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	var out []byte
+	encode := func(a, b, c byte, count int) {
+		value := uint(a)<<16 | uint(b)<<8 | uint(c)
+		for ; count > 0; count-- {
+			out = append(out, itoa64[value&0x3f])
+			value >>= 6
+		}
+	}
+	encode(final[0], final[6], final[12], 4)
+	encode(final[1], final[7], final[13], 4)
+	encode(final[2], final[8], final[14], 4)
+	encode(final[3], final[9], final[15], 4)
+	encode(final[4], final[10], final[5], 4)
+	encode(0, 0, final[11], 2)
+	return magic + salt + "$" + string(out)
+}
+
+// proxyAuth trusts a proxy in front of goki to log users in, and to pass on
+//  who they are in request headers
+type proxyAuth struct {
+	userHeader  string
+	groupHeader string
+	trusted     []*net.IPNet
+}
+
+func newProxyAuth(c AuthSection) (*proxyAuth, error) {
+	if c.UserHeader == "" {
+		return nil, &Error{Code: ErrBadAuth, path: c.Type, value: "no UserHeader given"}
+	}
+	if len(c.TrustedProxies) == 0 {
+		return nil, &Error{Code: ErrBadAuth, path: c.Type, value: "no TrustedProxies given"}
+	}
+
+	a := &proxyAuth{userHeader: c.UserHeader, groupHeader: c.GroupHeader}
+	for _, proxy := range c.TrustedProxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, &Error{Code: ErrBadAuth, path: c.Type, value: err.Error()}
+		}
+		a.trusted = append(a.trusted, network)
+	}
+	return a, nil
+}
+
+// Authenticate reads the user from the headers, if the request came from
+//  one of the trusted proxies
+func (a *proxyAuth) Authenticate(r *http.Request) User {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	var trusted bool
+	for _, network := range a.trusted {
+		if ip != nil && network.Contains(ip) {
+			trusted = true
+		}
+	}
+	if !trusted {
+		return User{}
+	}
+
+	user := User{Name: strings.TrimSpace(r.Header.Get(a.userHeader))}
+	if user.Name == "" || a.groupHeader == "" {
+		return user
+	}
+	for _, group := range strings.Split(r.Header.Get(a.groupHeader), ",") {
+		if group = normalizeTag(group); group != "" {
+			user.Groups = append(user.Groups, group)
+		}
+	}
+	return user
+}
+
+func (a *proxyAuth) Challenge(w http.ResponseWriter) {
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+// inAny checks if the user may see a page open to the given groups
+func (u *User) inAny(groups []string) bool {
+	for _, group := range groups {
+		if group == everyone {
+			return true
+		}
+		for _, own := range u.Groups {
+			if normalizeTag(own) == normalizeTag(group) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// accessQuery matches the pages in the index the user may see - those open
+//  to everyone, or to one of the user's groups
+func (u *User) accessQuery() blevequery.Query {
+	var anyGroup []blevequery.Query
+	for _, group := range append([]string{everyone}, u.Groups...) {
+		termQuery := bleve.NewTermQuery(normalizeTag(group))
+		termQuery.SetField("access")
+		anyGroup = append(anyGroup, termQuery)
+	}
+	disjunction := bleve.NewDisjunctionQuery(anyGroup...)
+	disjunction.SetMin(1)
+	return disjunction
+}
+
+// accessGroups gives the groups to index a page with - everyone, if the
+//  page is not limited to any group
+func accessGroups(pdata *PageMetadata, topicGroups map[string][]string) []string {
+	if groups := pdata.Groups(topicGroups); len(groups) > 0 {
+		return groups
+	}
+	return []string{everyone}
+}
+
+// accessControl decides which pages each request may see, for the handlers
+//  under an index. A nil accessControl lets every request see every page.
+type accessControl struct {
+	auth        Authenticator
+	topicGroups map[string][]string
+}
+
+// viewer gives the user making a request, or nil if access is not checked
+func (a *accessControl) viewer(r *http.Request) *User {
+	if a == nil {
+		return nil
+	}
+	user := a.auth.Authenticate(r)
+	return &user
+}
+
+// allowed checks if the viewer may see a page
+func (a *accessControl) allowed(viewer *User, pdata *PageMetadata) bool {
+	if a == nil || viewer == nil {
+		return true
+	}
+	groups := pdata.Groups(a.topicGroups)
+	return len(groups) == 0 || viewer.inAny(groups)
+}
+
+// deny answers a request for a page the viewer may not see - asking them to
+//  log in if they have not
+func (a *accessControl) deny(w http.ResponseWriter, r *http.Request, viewer *User) {
+	if viewer == nil || viewer.Name == "" {
+		log.Printf("request [ %s ] needs a login", r.URL.Path)
+		a.auth.Challenge(w)
+		return
+	}
+	log.Printf("request [ %s ] is not open to [ %s ]", r.URL.Path, viewer.Name)
+	http.Error(w, "Forbidden", http.StatusForbidden)
+}
+
+// relatedKey is what the related pages of a page are cached under - the
+//  same page has different related pages for viewers in different groups
+func relatedKey(uriPath string, viewer *User) string {
+	if viewer == nil {
+		return uriPath
+	}
+	groups := append([]string(nil), viewer.Groups...)
+	sort.Strings(groups)
+	return uriPath + "\n" + strings.Join(groups, ",")
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckPassword(t *testing.T) {
+	assert.Equal(t, "$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0", apr1("secret", "saltsalt"))
+
+	var tests = []struct {
+		hash     string
+		password string
+		expected bool
+	}{
+		{"$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0", "secret", true},
+		{"$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0", "Secret", false},
+		{"{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "secret", true},
+		{"{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "", false},
+		{"secret", "secret", false},
+	}
+	for _, testSet := range tests {
+		assert.Equal(t, testSet.expected, checkPassword(testSet.hash, testSet.password),
+			"hash [%q] with password [%q]", testSet.hash, testSet.password)
+	}
+}
+
+func TestHtpasswdAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "access.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestTree(t, dir, map[string]string{
+		"htpasswd": "# users\njack:$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0\njill:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n",
+		"groups":   "Ops: jack jill\nsecurity: jill\n",
+		"bcrypt":   "jack:$2y$05$abcdefghijklmnopqrstuv\n",
+	})
+
+	_, err = NewAuthenticator(AuthSection{Type: "htpasswd"})
+	assert.Error(t, err, "htpasswd needs a file")
+	_, err = NewAuthenticator(AuthSection{Type: "htpasswd", HtpasswdFile: filepath.Join(dir, "bcrypt")})
+	assert.Error(t, err, "a hash that can not be checked should be an error")
+
+	auth, err := NewAuthenticator(AuthSection{
+		Type:         "htpasswd",
+		HtpasswdFile: filepath.Join(dir, "htpasswd"),
+		GroupFile:    filepath.Join(dir, "groups"),
+	})
+	assert.NoError(t, err)
+
+	var tests = []struct {
+		user     string
+		pass     string
+		expected User
+	}{
+		{"jack", "secret", User{Name: "jack", Groups: []string{"ops"}}},
+		{"jill", "secret", User{Name: "jill", Groups: []string{"ops", "security"}}},
+		{"jill", "wrong", User{}},
+		{"nobody", "secret", User{}},
+	}
+	for _, testSet := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.SetBasicAuth(testSet.user, testSet.pass)
+		assert.Equal(t, testSet.expected, auth.Authenticate(r),
+			"user [%q] pass [%q]", testSet.user, testSet.pass)
+	}
+	assert.Equal(t, User{}, auth.Authenticate(httptest.NewRequest("GET", "/", nil)))
+
+	w := httptest.NewRecorder()
+	auth.Challenge(w)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, `Basic realm="goki"`, w.Header().Get("WWW-Authenticate"))
+}
+
+func TestProxyAuth(t *testing.T) {
+	_, err := NewAuthenticator(AuthSection{Type: "proxy", UserHeader: "X-User"})
+	assert.Error(t, err, "a proxy has to be trusted")
+	_, err = NewAuthenticator(AuthSection{Type: "proxy", UserHeader: "X-User",
+		TrustedProxies: []string{"not an address"}})
+	assert.Error(t, err)
+	_, err = NewAuthenticator(AuthSection{Type: "kerberos"})
+	assert.Error(t, err)
+
+	auth, err := NewAuthenticator(AuthSection{
+		Type:           "proxy",
+		UserHeader:     "X-User",
+		GroupHeader:    "X-Groups",
+		TrustedProxies: []string{"10.0.0.1", "192.168.0.0/16"},
+	})
+	assert.NoError(t, err)
+
+	var tests = []struct {
+		remote   string
+		user     string
+		groups   string
+		expected User
+	}{
+		{"10.0.0.1:4000", "jack", "Ops, security,", User{Name: "jack", Groups: []string{"ops", "security"}}},
+		{"192.168.4.20:4000", "jill", "", User{Name: "jill"}},
+		{"10.0.0.2:4000", "jack", "ops", User{}},
+		{"10.0.0.1:4000", "", "ops", User{}},
+	}
+	for _, testSet := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = testSet.remote
+		r.Header.Set("X-User", testSet.user)
+		r.Header.Set("X-Groups", testSet.groups)
+		assert.Equal(t, testSet.expected, auth.Authenticate(r), "request from [%s]", testSet.remote)
+	}
+}
+
+func TestPageGroups(t *testing.T) {
+	pdata := &PageMetadata{
+		Topics: map[string]bool{"internal": true, "linux": true},
+		Access: map[string]bool{"security": true},
+	}
+	topicGroups := map[string][]string{"Internal": {"Ops", "security"}, "ssl": {"web"}}
+	assert.Equal(t, []string{"ops", "security"}, pdata.Groups(topicGroups))
+	assert.Equal(t, []string{"ops", "security"}, accessGroups(pdata, topicGroups))
+	assert.Equal(t, []string{everyone}, accessGroups(&PageMetadata{}, topicGroups))
+
+	a := &accessControl{auth: anonymousAuth{}, topicGroups: topicGroups}
+	assert.True(t, a.allowed(&User{Name: "jack", Groups: []string{"ops"}}, pdata))
+	assert.False(t, a.allowed(&User{Name: "jill", Groups: []string{"web"}}, pdata))
+	assert.False(t, a.allowed(&User{}, pdata))
+	assert.True(t, a.allowed(&User{}, &PageMetadata{}), "a page without groups is open to everyone")
+	assert.True(t, a.allowed(&User{}, &PageMetadata{Access: map[string]bool{everyone: true}}))
+
+	var unchecked *accessControl
+	assert.True(t, unchecked.allowed(unchecked.viewer(httptest.NewRequest("GET", "/", nil)), pdata),
+		"without access control, every page is open")
+}
+
+func TestRelatedKey(t *testing.T) {
+	assert.Equal(t, "/disk.md", relatedKey("/disk.md", nil))
+	assert.Equal(t, relatedKey("/disk.md", &User{Name: "jack", Groups: []string{"web", "ops"}}),
+		relatedKey("/disk.md", &User{Name: "jill", Groups: []string{"ops", "web"}}),
+		"users in the same groups see the same related pages")
+	assert.NotEqual(t, relatedKey("/disk.md", &User{Groups: []string{"ops"}}),
+		relatedKey("/disk.md", &User{}))
+}
+
+func TestAccessHandlers(t *testing.T) {
+	root, err := ioutil.TempDir("", "access.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	writeTestTree(t, root, map[string]string{
+		"open.md":     "Title: Open\n\nfor everyone\n",
+		"internal.md": "Title: Internal\nTopic: internal\n\nops only\n",
+		"audit.md":    "Title: Audit\nAccess: security\n\nsecurity only\n",
+		"broken.md":   "---\ntitle: [unclosed\n---\nnobody knows\n",
+
+		"ops/index.md":          "Title: Ops\nTopic: internal\n\nthe ops pages\n",
+		"ops/diagram.svg":       "<svg/>",
+		"ops/runbooks/disk.txt": "df -h",
+		"lost/index.md":         "---\naccess: [unclosed\n---\n",
+		"lost/notes.txt":        "who can see this",
+		"public/attachment.txt": "for everyone",
+	})
+
+	proxy, err := NewAuthenticator(AuthSection{
+		Type:           "proxy",
+		UserHeader:     "X-User",
+		GroupHeader:    "X-Groups",
+		TrustedProxies: []string{"192.0.2.1"},
+	})
+	assert.NoError(t, err)
+	access := &accessControl{auth: proxy, topicGroups: map[string][]string{"internal": {"ops"}}}
+
+	markdown := Markdown{c: ServerSection{Path: root, Prefix: "/", ListTemplate: "listing.html"}, a: access}
+	raw := RawFile{c: ServerSection{Path: root}, a: access}
+
+	var tests = []struct {
+		request  string
+		user     string
+		groups   string
+		expected int
+	}{
+		{"/internal.md", "", "", http.StatusUnauthorized},
+		{"/internal.md", "jill", "security", http.StatusForbidden},
+		{"/internal.md", "jack", "ops", http.StatusOK},
+		{"/audit.md", "jack", "ops", http.StatusForbidden},
+		{"/audit.md", "jill", "security", http.StatusOK},
+		{"/open.md", "", "", http.StatusOK},
+		{"/broken.md", "jack", "ops", http.StatusForbidden},
+		{"/ops/diagram.svg", "jill", "security", http.StatusForbidden},
+		{"/ops/diagram.svg", "jack", "ops", http.StatusOK},
+		{"/ops/runbooks/disk.txt", "", "", http.StatusUnauthorized},
+		{"/ops/runbooks/disk.txt", "jack", "ops", http.StatusOK},
+		{"/lost/notes.txt", "jack", "ops", http.StatusForbidden},
+		{"/public/attachment.txt", "", "", http.StatusOK},
+	}
+	for _, testSet := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.URL.Path = testSet.request
+		r.Header.Set("X-User", testSet.user)
+		r.Header.Set("X-Groups", testSet.groups)
+		w := httptest.NewRecorder()
+		raw.ServeHTTP(w, r)
+		assert.Equal(t, testSet.expected, w.Code,
+			"[%s] for user [%q] got the wrong response", testSet.request, testSet.user)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-User", "jack")
+	r.Header.Set("X-Groups", "ops")
+	listing, err := markdown.listDirectory("", access.viewer(r))
+	assert.NoError(t, err)
+	assert.Equal(t, []ListingEntry{
+		{Title: "Internal", URIPath: "/internal"},
+		{Title: "Open", URIPath: "/open"},
+	}, listing.Pages, "only the pages the user may see should be listed")
+}
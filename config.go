@@ -21,14 +21,29 @@ var templateLock = new(sync.RWMutex)
 //  * Indexes is a child section - it's an array of IndexSection
 //  * Redirects is a child section - it's an array of RedirectSection
 type GlobalSection struct {
-	Address     string
-	Port        string
-	Hostname    string
-	TemplateDir string
-	CertFile    string
-	KeyFile     string
-	Indexes     []IndexSection
-	Redirects   []RedirectSection
+	Address      string
+	Port         string
+	Hostname     string
+	TemplateDir  string
+	CertFile     string
+	KeyFile      string
+	RedirectPort string
+	Indexes      []IndexSection
+	Redirects    []RedirectSection
+	Auth         AuthSection
+}
+
+// AuthSection picks how the users that may see pages limited to a group are
+//  identified - see TopicGroups in IndexSection, and the Access metadata of a
+//  page. Without a Type, nobody logs in.
+type AuthSection struct {
+	Type           string   // htpasswd or proxy
+	HtpasswdFile   string   // users and passwords, for htpasswd
+	GroupFile      string   // lines of "group: user user", for htpasswd
+	Realm          string   // realm of the login prompt, for htpasswd
+	UserHeader     string   // header with the user's name, for proxy
+	GroupHeader    string   // header with the user's groups, comma separated, for proxy
+	TrustedProxies []string // addresses or networks of the proxies, for proxy
 }
 
 // RedirectSection details each redirect to serve
@@ -42,25 +57,49 @@ type RedirectSection struct {
 //  used but handlers underneath are still processed.
 //  * Handlers is a child section - array of ServerSections
 type IndexSection struct {
-	WatchDirs      map[string]string // physical -> URI Location that we will be watching for updates
-	WatchExtension string            // file extensions that we will watch for within that dir
-	IndexPath      string            //location to store the index
-	IndexType      string            // type of index - likely "en"
-	IndexName      string            // name of the index
-	Restricted     []string          // Tags to restrict indexing on
+	WatchDirs      map[string]string   // physical -> URI Location that we will be watching for updates
+	WatchExtension string              // file extensions that we will watch for within that dir
+	WatchDelay     string              // how long to wait after the last change before indexing, ie "10s"
+	IndexHidden    bool                // also index hidden files and directories
+	MaxFileSize    int64               // largest file to index in bytes, 0 for no limit
+	IndexPath      string              //location to store the index
+	IndexType      string              // type of index - likely "en"
+	IndexName      string              // name of the index
+	Restricted     []string            // Tags to restrict indexing on
+	Fields         []FieldSection      // custom metadata to index
+	TopicGroups    map[string][]string // topic -> groups that may see pages with it
 	Handlers       []ServerSection
 }
 
+// FieldSection indexes a piece of custom metadata from each page. The values
+//  are indexed under custom.Field, which is the Metadata name lower cased if
+//  it is not given.
+type FieldSection struct {
+	Metadata string // name of the metadata in the page, ie "Owner"
+	Field    string // name of the field in the index
+	Type     string // text, keyword to match whole values, or date
+}
+
 // ServerSection details a handler to lay out
 type ServerSection struct {
-	Path             string   // filesystem path to serve out
-	Prefix           string   // Web URL Prefix - alternatively the prefix for a search handler
-	Default          string   // Default page to serve if empty URI - alternatively the facet to list against
-	Template         string   // Template file to build the response from
-	FallbackTemplate string   // template to fall back to for each handlers
-	ServerType       string   // markdown, raw, search, or facet to denote the type of Server handle
-	TopicURL         string   // URI prefix to redirect to topic pages
-	Restricted       []string // list of restricts - extensions for raw, topics for markdown
+	Path             string             // filesystem path to serve out
+	Prefix           string             // Web URL Prefix - alternatively the prefix for a search handler
+	Default          string             // Default page to serve if empty URI - alternatively the facet to list against
+	Template         string             // Template file to build the response from
+	FallbackTemplate string             // template to fall back to for each handlers
+	ServerType       string             // markdown, raw, search, or facet to denote the type of Server handle
+	TopicURL         string             // URI prefix to redirect to topic pages
+	Restricted       []string           // list of restricts - extensions for raw, topics for markdown
+	AdminGroup       string             // group a user has to be in to use the admin handler
+	PageSize         int                // results on each page when none is asked for
+	MaxPageSize      int                // the most results a page may ask for
+	Boosts           map[string]float64 // field -> boost for a fuzzy search term
+	Fuzziness        int                // edits allowed in each fuzzy search word
+	SnippetLength    int                // characters in the body snippet of each search result
+	Sort             string             // order of search results when none is asked for
+	SearchURL        string             // search that wiki links to missing pages go to
+	RelatedCount     int                // related pages listed on each markdown page, -1 for none
+	ListTemplate     string             // template to list a directory without an index.md
 }
 
 // GetConfig safely returns the config file
@@ -72,6 +111,18 @@ func GetConfig() *GlobalSection {
 
 // LoadConfig reads in a config file, cleans it up, and sets it to the global
 func LoadConfig(configFile string) error {
+	temp, err := ReadConfig(configFile)
+	if err != nil {
+		return err
+	}
+
+	SetConfig(temp)
+	return nil
+}
+
+// ReadConfig reads in a config file and cleans it up, without touching the
+//  global config.
+func ReadConfig(configFile string) (*GlobalSection, error) {
 	// set a default file
 	if configFile == "" {
 		configFile = "config.json"
@@ -80,7 +131,7 @@ func LoadConfig(configFile string) error {
 	// have to read in the line into a byte[] array
 	fileContents, err := ioutil.ReadFile(configFile)
 	if err != nil {
-		return &Error{Code: ErrReadConfig, innerError: err, value: configFile}
+		return nil, &Error{Code: ErrReadConfig, innerError: err, value: configFile}
 	}
 
 	// UnMarshal the config file that was read in
@@ -89,16 +140,18 @@ func LoadConfig(configFile string) error {
 	err = json.Unmarshal(fileContents, temp)
 	//Make sure you were able to read it in
 	if err != nil {
-		return &Error{Code: ErrParseConfig, value: temp, innerError: err}
+		return nil, &Error{Code: ErrParseConfig, value: temp, innerError: err}
 	}
 
 	CleanConfig(temp)
+	return temp, nil
+}
 
+// SetConfig safely replaces the global config
+func SetConfig(config *GlobalSection) {
 	configLock.Lock()
-	staticConfig = temp
+	staticConfig = config
 	configLock.Unlock()
-
-	return nil
 }
 
 // CleanConfig takes a given config struct, and makes sure values are valid
@@ -144,13 +197,33 @@ func RenderTemplate(responsePipe http.ResponseWriter, templateName string,
 
 // ParseTemplates parses all templates in a folder into one global template
 func ParseTemplates(globalConfig GlobalSection) error {
-	newTemplate, err := template.ParseGlob(globalConfig.TemplateDir + "*")
+	newTemplate, err := ReadTemplates(globalConfig)
 	if err != nil {
-		return &Error{Code: ErrParseTemplates, innerError: err}
+		return err
 	}
 
+	SetTemplates(newTemplate)
+	return nil
+}
+
+// ReadTemplates parses all templates in a folder, without touching the
+//  global template.
+func ReadTemplates(globalConfig GlobalSection) (*template.Template, error) {
+	newTemplate, err := template.ParseGlob(templateGlob(globalConfig))
+	if err != nil {
+		return nil, &Error{Code: ErrParseTemplates, innerError: err}
+	}
+	return newTemplate, nil
+}
+
+// SetTemplates safely replaces the global template
+func SetTemplates(newTemplate *template.Template) {
 	templateLock.Lock()
 	defer templateLock.Unlock()
 	allTemplates = newTemplate
-	return nil
+}
+
+// templateGlob gives the pattern that matches all of the template files
+func templateGlob(globalConfig GlobalSection) string {
+	return filepath.Join(globalConfig.TemplateDir, "*")
 }
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// the page served for a directory, if it has one
+const directoryIndex = "index.md"
+
+// the title of the top of a markdown handler without its own index page
+const rootTitle = "Home"
+
+// Breadcrumb is a directory above the page being shown
+type Breadcrumb struct {
+	Title   string
+	URIPath string
+}
+
+// ListingEntry is a page or directory within a directory listing
+type ListingEntry struct {
+	Title   string
+	URIPath string
+}
+
+// DirectoryListing is the data used to render a directory that does not have
+//  an index page
+type DirectoryListing struct {
+	Title       string
+	URIPath     string
+	Breadcrumbs []Breadcrumb
+	Directories []ListingEntry
+	Pages       []ListingEntry
+}
+
+// dirURI gives the URI of a directory within the handler, with a trailing /
+func (h Markdown) dirURI(dir string) string {
+	uri := path.Join(h.c.Prefix, dir)
+	if !strings.HasSuffix(uri, "/") {
+		uri += "/"
+	}
+	return uri
+}
+
+// visible checks if a page may be listed for the viewer - it is not
+//  restricted, and the viewer may see it
+func (h Markdown) visible(pdata *PageMetadata, viewer *User) bool {
+	return !pdata.MatchedTopic(h.c.Restricted) && h.a.allowed(viewer, pdata)
+}
+
+// dirTitle gives the title of a directory within the handler - the title of
+//  its index page, or its name if it does not have one the viewer may see
+func (h Markdown) dirTitle(dir string, viewer *User) string {
+	pdata := new(PageMetadata)
+	indexPath := filepath.Join(h.c.Path, filepath.FromSlash(dir), directoryIndex)
+	if isFile(indexPath) && pdata.LoadPage(indexPath) == nil && h.visible(pdata, viewer) {
+		return pdata.Title
+	}
+	if dir = path.Clean(dir); dir == "." || dir == "/" {
+		return rootTitle
+	}
+	return path.Base(dir)
+}
+
+// breadcrumbs gives a crumb for each directory above the page or directory
+//  at rel, starting from the top of the handler. A directory's index page is
+//  the directory, so it does not get a crumb for its own directory.
+func (h Markdown) breadcrumbs(rel string, viewer *User) []Breadcrumb {
+	if path.Base(rel) == directoryIndex {
+		rel = path.Dir(rel)
+	}
+	rel = strings.Trim(path.Clean(strings.TrimSuffix(rel, ".md")), "/")
+	if rel == "." || rel == "" {
+		return nil
+	}
+
+	segments := strings.Split(rel, "/")
+	var crumbs []Breadcrumb
+	for depth := 0; depth < len(segments); depth++ {
+		dir := path.Join(segments[:depth]...)
+		crumbs = append(crumbs, Breadcrumb{Title: h.dirTitle(dir, viewer), URIPath: h.dirURI(dir)})
+	}
+	return crumbs
+}
+
+// listDirectory lists the pages and directories within dir. Hidden files,
+//  files that are not markdown, restricted pages, and pages the viewer may
+//  not see are left out.
+func (h Markdown) listDirectory(dir string, viewer *User) (DirectoryListing, error) {
+	dirPath := filepath.Join(h.c.Path, filepath.FromSlash(dir))
+	files, err := ioutil.ReadDir(dirPath)
+	if err != nil {
+		return DirectoryListing{}, &Error{Code: ErrFileRead, value: dirPath, innerError: err}
+	}
+
+	listing := DirectoryListing{
+		Title:       h.dirTitle(dir, viewer),
+		URIPath:     h.dirURI(dir),
+		Breadcrumbs: h.breadcrumbs(dir, viewer),
+	}
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasPrefix(name, ".") || name == directoryIndex {
+			continue
+		}
+		child := path.Join(dir, name)
+
+		if file.IsDir() {
+			listing.Directories = append(listing.Directories,
+				ListingEntry{Title: h.dirTitle(child, viewer), URIPath: h.dirURI(child)})
+			continue
+		}
+		if path.Ext(name) != ".md" {
+			continue
+		}
+
+		pdata := new(PageMetadata)
+		if err := pdata.LoadPage(filepath.Join(dirPath, name)); err != nil ||
+			!h.visible(pdata, viewer) {
+			continue
+		}
+		listing.Pages = append(listing.Pages, ListingEntry{
+			Title:   pdata.Title,
+			URIPath: path.Join(h.c.Prefix, strings.TrimSuffix(child, ".md")),
+		})
+	}
+	return listing, nil
+}
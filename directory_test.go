@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestTree writes out files, keyed by their path under root
+func writeTestTree(t *testing.T, root string, files map[string]string) {
+	for name, contents := range files {
+		filePath := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filePath, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDirectories(t *testing.T) {
+	root, err := ioutil.TempDir("", "directories.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	writeTestTree(t, root, map[string]string{
+		"index.md":                   "Title: Operations Wiki\n\nhello\n",
+		"runbooks/index.md":          "Title: Runbooks\n\nall of them\n",
+		"runbooks/linux/disk.md":     "Title: Disk Usage\n\nfull\n",
+		"runbooks/linux/memory.md":   "Title: Memory\n\nswap\n",
+		"runbooks/linux/secret.md":   "Title: Secret\nTopic: internal\n\nhidden\n",
+		"runbooks/linux/.draft.md":   "Title: Draft\n\nnot yet\n",
+		"runbooks/linux/diagram.png": "png",
+		"runbooks/linux/ssl/cert.md": "Title: Certificates\n\nrenew\n",
+		"runbooks/linux.md":          "Title: Linux\n\nthe page wins\n",
+	})
+
+	h := Markdown{c: ServerSection{
+		Path:         root,
+		Prefix:       "/wiki/",
+		Restricted:   []string{"internal"},
+		ListTemplate: "listing.html",
+	}}
+
+	assert.Nil(t, h.breadcrumbs("index.md", nil), "the top page has nothing above it")
+	assert.Equal(t, []Breadcrumb{{Title: "Operations Wiki", URIPath: "/wiki/"}},
+		h.breadcrumbs("runbooks/index.md", nil), "an index page is its own directory")
+	assert.Equal(t, []Breadcrumb{
+		{Title: "Operations Wiki", URIPath: "/wiki/"},
+		{Title: "Runbooks", URIPath: "/wiki/runbooks/"},
+		{Title: "linux", URIPath: "/wiki/runbooks/linux/"},
+	}, h.breadcrumbs("runbooks/linux/disk.md", nil), "a directory without an index uses its name")
+
+	listing, err := h.listDirectory("runbooks/linux", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "linux", listing.Title)
+	assert.Equal(t, "/wiki/runbooks/linux/", listing.URIPath)
+	assert.Len(t, listing.Breadcrumbs, 2)
+	assert.Equal(t, []ListingEntry{{Title: "ssl", URIPath: "/wiki/runbooks/linux/ssl/"}},
+		listing.Directories)
+	assert.Equal(t, []ListingEntry{
+		{Title: "Disk Usage", URIPath: "/wiki/runbooks/linux/disk"},
+		{Title: "Memory", URIPath: "/wiki/runbooks/linux/memory"},
+	}, listing.Pages, "hidden, restricted, and non-markdown files should be left out")
+
+	var served string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served = r.URL.Path
+	})
+	var tests = []struct {
+		request string
+		served  string
+	}{
+		{"runbooks", "runbooks/index.md"},
+		{"runbooks/linux/disk", "runbooks/linux/disk"},
+		{"runbooks/linux", "runbooks/linux"},
+	}
+	for _, testSet := range tests {
+		served = ""
+		r := httptest.NewRequest("GET", "/", nil)
+		r.URL.Path = testSet.request
+		h.directoryServe(next).ServeHTTP(httptest.NewRecorder(), r)
+		assert.Equal(t, testSet.served, served, "[%s] went to the wrong page", testSet.request)
+	}
+
+	served = ""
+	r := httptest.NewRequest("GET", "/?format=json", nil)
+	r.URL.Path = "runbooks/linux/ssl"
+	w := httptest.NewRecorder()
+	h.directoryServe(next).ServeHTTP(w, r)
+	assert.Equal(t, "", served, "a directory without an index should be listed")
+	var decoded DirectoryListing
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &decoded))
+	assert.Equal(t, []ListingEntry{{Title: "Certificates", URIPath: "/wiki/runbooks/linux/ssl/cert"}},
+		decoded.Pages)
+
+	h.c.ListTemplate = ""
+	w = httptest.NewRecorder()
+	h.directoryServe(next).ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNotFound, w.Code, "without a template there is no listing")
+}
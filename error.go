@@ -59,6 +59,22 @@ const (
 	ErrListField
 	ErrFormatSearchResponse
 	ErrResultsFormatType
+	ErrLoadCert
+	ErrIndexClosing
+	ErrWatcherError
+	ErrBadDuration
+	ErrBadIgnore
+	ErrRebuildRunning
+	ErrNoFileForURI
+	ErrBadDate
+	ErrBadFrontMatter
+	ErrBadFieldType
+	ErrBadAuthType
+	ErrBadAuth
+	ErrBadHtpasswd
+	ErrBadGroupFile
+	ErrBadPrefix
+	ErrBuildMuxer
 )
 
 // specify the error message for each error
@@ -84,4 +100,20 @@ var errMsg = map[int]string{
 	ErrListField:            "could not list field - %v",
 	ErrFormatSearchResponse: "ran into an issue formatting the results - %v",
 	ErrResultsFormatType:    "returned %s was of the wrong type - %#v",
+	ErrLoadCert:             "failed to load certificate [%s] - %v",
+	ErrIndexClosing:         "index closed while crawling [%s]",
+	ErrWatcherError:         "watcher reported an error - %v",
+	ErrBadDuration:          "could not parse duration [%s] - %v",
+	ErrBadIgnore:            "bad pattern [%s] in ignore file - %v",
+	ErrRebuildRunning:       "index [%s] is already being rebuilt",
+	ErrNoFileForURI:         "no indexable file for [%s]",
+	ErrBadDate:              "bad date for [%s] - [%s]",
+	ErrBadFrontMatter:       "bad %s front matter - %v",
+	ErrBadFieldType:         "field [%s] has an unknown type [%s]",
+	ErrBadAuthType:          "unknown auth type [%s]",
+	ErrBadAuth:              "bad config for [%s] auth - %s",
+	ErrBadHtpasswd:          "htpasswd file [%s] has an unsupported entry for [%s]",
+	ErrBadGroupFile:         "bad line in group file [%s] - [%s]",
+	ErrBadPrefix:            "prefix [%s] %s",
+	ErrBuildMuxer:           "could not build the handlers - %v",
 }
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	blevequery "github.com/blevesearch/bleve/search/query"
+)
+
+// the most values returned for each term facet of a search
+const facetSize = 20
+
+// SearchFilters narrow a search down to pages with any of the given topics,
+//  any of the given authors, and any of the given keywords, that were modified
+//  within the named range, and between Since and Until if they are set. Custom
+//  narrows each custom field down to any of its values, and CustomDates each
+//  custom date field down to any of its ranges. With a Viewer, only pages
+//  they may see are found.
+type SearchFilters struct {
+	Topics   []string            `form:"topic,omitempty"`
+	Authors  []string            `form:"author,omitempty"`
+	Keywords []string            `form:"keyword,omitempty"`
+	Modified string              `form:"modified,omitempty"`
+	Since    time.Time           `form:"since,omitempty"`
+	Until    time.Time           `form:"until,omitempty"`
+	Custom   map[string][]string `form:"-"`
+	// CustomDates are the filters on custom fields with the date Type
+	CustomDates map[string][]dateRange `form:"-"`
+	Viewer      *User                  `form:"-"`
+}
+
+// custom fields are filtered by form values with their name in the index,
+//  such as custom.owner
+const customPrefix = "custom."
+
+// the layouts an absolute date can be given in
+var dateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// the units a relative date can be given in, besides the ones
+//  time.ParseDuration takes
+var dateUnits = map[string]time.Duration{
+	"d": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour,
+	"y": 365 * 24 * time.Hour,
+}
+
+// parseDate reads the named date as either an absolute date, or a time before
+//  now such as 7d or 12h. A date without a time is the start of that day, or
+//  the end of that day if endOfDay is set. An empty value gives the zero time.
+func parseDate(name, value string, now time.Time, endOfDay bool) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	for _, layout := range dateLayouts {
+		date, err := time.ParseInLocation(layout, value, now.Location())
+		if err != nil {
+			continue
+		}
+		if layout == "2006-01-02" && endOfDay {
+			date = date.AddDate(0, 0, 1)
+		}
+		return date, nil
+	}
+
+	for suffix, unit := range dateUnits {
+		if count, err := strconv.Atoi(strings.TrimSuffix(value, suffix)); err == nil &&
+			strings.HasSuffix(value, suffix) && count >= 0 {
+			return now.Add(-time.Duration(count) * unit), nil
+		}
+	}
+	if ago, err := time.ParseDuration(value); err == nil && ago >= 0 {
+		return now.Add(-ago), nil
+	}
+
+	return time.Time{}, &Error{Code: ErrBadDate, path: name, value: value}
+}
+
+// FacetValue is one value of a facet, with the number of results that have
+//  it. Link narrows the current search down to that value, or if the value is
+//  already Selected, removes it from the search.
+type FacetValue struct {
+	Value    string
+	Count    int
+	Selected bool
+	Link     string
+}
+
+// SearchFacets break the results of a search down by each field
+type SearchFacets struct {
+	Topics   []FacetValue
+	Authors  []FacetValue
+	Keywords []FacetValue
+	Modified []FacetValue
+}
+
+// the fields with a term facet - each is also the form value it is filtered by
+var termFacets = []string{"topic", "author", "keyword"}
+
+type dateRange struct {
+	name  string
+	start time.Time
+	end   time.Time
+}
+
+// modifiedRanges are the named ranges the modified facet counts pages in.
+//  Each range but older runs up to now, so they overlap.
+func modifiedRanges(now time.Time) []dateRange {
+	return []dateRange{
+		{name: "day", start: now.AddDate(0, 0, -1)},
+		{name: "week", start: now.AddDate(0, 0, -7)},
+		{name: "month", start: now.AddDate(0, -1, 0)},
+		{name: "year", start: now.AddDate(-1, 0, 0)},
+		{name: "older", end: now.AddDate(-1, 0, 0)},
+	}
+}
+
+// customDateRange reads the filter on a custom date field - a range of
+//  since..until, either of which may be left out, or a single date, which
+//  is the whole of that day, or a time, which is that second.
+func customDateRange(name, value string, now time.Time) (dateRange, error) {
+	since, until := value, value
+	if at := strings.Index(value, ".."); at >= 0 {
+		since, until = value[:at], value[at+2:]
+	}
+	start, err := parseDate(name, since, now, false)
+	if err != nil {
+		return dateRange{}, err
+	}
+	end, err := parseDate(name, until, now, true)
+	if err != nil {
+		return dateRange{}, err
+	}
+	if start.IsZero() && end.IsZero() {
+		return dateRange{}, &Error{Code: ErrBadDate, path: name, value: value}
+	}
+	if !start.IsZero() && end.Equal(start) {
+		// dates are stored to the second
+		end = end.Add(time.Second)
+	}
+	return dateRange{name: value, start: start, end: end}, nil
+}
+
+// searchFilters reads the filters out of a request's form values. Custom
+//  fields with the date Type among fields are filtered by date.
+func searchFilters(form url.Values, fields []FieldSection) (SearchFilters, error) {
+	filters := SearchFilters{
+		Topics:   normalizeTags(form["topic"]),
+		Authors:  normalizeTags(form["author"]),
+		Keywords: normalizeTags(form["keyword"]),
+		Modified: form.Get("modified"),
+	}
+	dates := make(map[string]bool)
+	for _, field := range fields {
+		if field.Type == fieldDate {
+			dates[customPrefix+customField(field)] = true
+		}
+	}
+
+	now := time.Now()
+	for key, values := range form {
+		if !strings.HasPrefix(key, customPrefix) || len(key) == len(customPrefix) {
+			continue
+		}
+		if !dates[key] {
+			if filters.Custom == nil {
+				filters.Custom = make(map[string][]string)
+			}
+			filters.Custom[key] = values
+			continue
+		}
+		for _, value := range values {
+			r, err := customDateRange(key, value, now)
+			if err != nil {
+				return SearchFilters{}, err
+			}
+			if filters.CustomDates == nil {
+				filters.CustomDates = make(map[string][]dateRange)
+			}
+			filters.CustomDates[key] = append(filters.CustomDates[key], r)
+		}
+	}
+
+	var err error
+	filters.Since, err = parseDate("since", form.Get("since"), now, false)
+	if err != nil {
+		return SearchFilters{}, err
+	}
+	filters.Until, err = parseDate("until", form.Get("until"), now, true)
+	if err != nil {
+		return SearchFilters{}, err
+	}
+	return filters, nil
+}
+
+// normalizeTags normalizes each tag given to filter on, dropping empty ones
+func normalizeTags(tags []string) []string {
+	var normalized []string
+	for _, tag := range tags {
+		if tag = normalizeTag(tag); tag != "" {
+			normalized = append(normalized, tag)
+		}
+	}
+	return normalized
+}
+
+// queries gives a query for each filter that is set - a page must match all
+//  of them.
+func (f SearchFilters) queries(now time.Time) []blevequery.Query {
+	var queries []blevequery.Query
+	for id, terms := range [][]string{f.Topics, f.Authors, f.Keywords} {
+		field := termFacets[id]
+		var anyTerm []blevequery.Query
+		for _, term := range terms {
+			termQuery := bleve.NewTermQuery(term)
+			termQuery.SetField(field)
+			anyTerm = append(anyTerm, termQuery)
+		}
+		switch {
+		case len(anyTerm) > 1:
+			disjunction := bleve.NewDisjunctionQuery(anyTerm...)
+			disjunction.SetMin(1)
+			queries = append(queries, disjunction)
+		case len(anyTerm) == 1:
+			queries = append(queries, anyTerm[0])
+		}
+	}
+
+	for field, values := range f.Custom {
+		var anyValue []blevequery.Query
+		for _, value := range values {
+			matchQuery := bleve.NewMatchQuery(value)
+			matchQuery.SetField(field)
+			anyValue = append(anyValue, matchQuery)
+		}
+		switch {
+		case len(anyValue) > 1:
+			disjunction := bleve.NewDisjunctionQuery(anyValue...)
+			disjunction.SetMin(1)
+			queries = append(queries, disjunction)
+		case len(anyValue) == 1:
+			queries = append(queries, anyValue[0])
+		}
+	}
+
+	for field, ranges := range f.CustomDates {
+		var anyRange []blevequery.Query
+		for _, r := range ranges {
+			rangeQuery := bleve.NewDateRangeQuery(r.start, r.end)
+			rangeQuery.SetField(field)
+			anyRange = append(anyRange, rangeQuery)
+		}
+		switch {
+		case len(anyRange) > 1:
+			disjunction := bleve.NewDisjunctionQuery(anyRange...)
+			disjunction.SetMin(1)
+			queries = append(queries, disjunction)
+		case len(anyRange) == 1:
+			queries = append(queries, anyRange[0])
+		}
+	}
+
+	for _, r := range modifiedRanges(now) {
+		if r.name == f.Modified {
+			rangeQuery := bleve.NewDateRangeQuery(r.start, r.end)
+			rangeQuery.SetField("modified")
+			queries = append(queries, rangeQuery)
+		}
+	}
+
+	if !f.Since.IsZero() || !f.Until.IsZero() {
+		rangeQuery := bleve.NewDateRangeQuery(f.Since, f.Until)
+		rangeQuery.SetField("modified")
+		queries = append(queries, rangeQuery)
+	}
+
+	if f.Viewer != nil {
+		queries = append(queries, f.Viewer.accessQuery())
+	}
+	return queries
+}
+
+// filterQuery narrows a query down with the filters
+func filterQuery(query blevequery.Query, f SearchFilters) blevequery.Query {
+	queries := f.queries(time.Now())
+	if len(queries) == 0 {
+		return query
+	}
+	return bleve.NewConjunctionQuery(append([]blevequery.Query{query}, queries...)...)
+}
+
+// addFacets asks a search for each of the facets in SearchFacets
+func addFacets(request *bleve.SearchRequest) {
+	for _, field := range termFacets {
+		request.AddFacet(field, bleve.NewFacetRequest(field, facetSize))
+	}
+
+	ranges := modifiedRanges(time.Now())
+	modified := bleve.NewFacetRequest("modified", len(ranges))
+	for _, r := range ranges {
+		modified.AddDateTimeRange(r.name, r.start, r.end)
+	}
+	request.AddFacet("modified", modified)
+}
+
+// buildFacets pulls the facets added by addFacets out of a search result
+func buildFacets(results *bleve.SearchResult) SearchFacets {
+	var facets SearchFacets
+	if results == nil || results.Facets == nil {
+		return facets
+	}
+
+	for _, field := range termFacets {
+		result, ok := results.Facets[field]
+		if !ok || result == nil {
+			continue
+		}
+		var values []FacetValue
+		for _, term := range result.Terms {
+			values = append(values, FacetValue{Value: term.Term, Count: term.Count})
+		}
+		switch field {
+		case "topic":
+			facets.Topics = values
+		case "author":
+			facets.Authors = values
+		case "keyword":
+			facets.Keywords = values
+		}
+	}
+
+	// bleve sorts ranges by count, put them back in order
+	if result, ok := results.Facets["modified"]; ok && result != nil {
+		counts := make(map[string]int)
+		for _, dateRange := range result.DateRanges {
+			counts[dateRange.Name] = dateRange.Count
+		}
+		for _, r := range modifiedRanges(time.Now()) {
+			facets.Modified = append(facets.Modified,
+				FacetValue{Value: r.name, Count: counts[r.name]})
+		}
+	}
+	return facets
+}
+
+// SetFacetLinks marks the facet values already in the given form values as
+//  Selected, and links each value to the current search with that value
+//  toggled, starting back on the first page.
+func (s *SearchResponse) SetFacetLinks(form url.Values) {
+	toggle := func(key string, values []FacetValue, only bool) {
+		for id, value := range values {
+			links := url.Values{}
+			for k, v := range form {
+				if k != "page" {
+					links[k] = v
+				}
+			}
+
+			var kept []string
+			for _, existing := range form[key] {
+				if normalizeTag(existing) == value.Value {
+					values[id].Selected = true
+				} else if !only {
+					kept = append(kept, existing)
+				}
+			}
+			if !values[id].Selected {
+				kept = append(kept, value.Value)
+			}
+
+			if len(kept) > 0 {
+				links[key] = kept
+			} else {
+				delete(links, key)
+			}
+			values[id].Link = "?" + links.Encode()
+		}
+	}
+
+	toggle("topic", s.Facets.Topics, false)
+	toggle("author", s.Facets.Authors, false)
+	toggle("keyword", s.Facets.Keywords, false)
+	toggle("modified", s.Facets.Modified, true)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSearchFilters(t *testing.T) {
+	form, err := url.ParseQuery("s=disk&topic=linux&topic=ssl&author=jack&modified=week")
+	assert.NoError(t, err)
+
+	filters, err := searchFilters(form, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"linux", "ssl"}, filters.Topics)
+	assert.Equal(t, []string{"jack"}, filters.Authors)
+	assert.Nil(t, filters.Keywords)
+	assert.Equal(t, "week", filters.Modified)
+
+	now := time.Now()
+	assert.Len(t, filters.queries(now), 3, "topics, authors, and modified should each be a query")
+	assert.Len(t, SearchFilters{}.queries(now), 0, "no filters should give no queries")
+	assert.Len(t, SearchFilters{Modified: "fortnight"}.queries(now), 0,
+		"an unknown range should be ignored")
+}
+
+func TestSearchFiltersNormalized(t *testing.T) {
+	form, err := url.ParseQuery("topic=Linux&topic=Load++Balancing&topic=+&author=J%C3%9CRGEN&keyword=SSL")
+	assert.NoError(t, err)
+
+	filters, err := searchFilters(form, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"linux", "load balancing"}, filters.Topics,
+		"topics should be filtered on as they are indexed")
+	assert.Equal(t, []string{"jürgen"}, filters.Authors)
+	assert.Equal(t, []string{"ssl"}, filters.Keywords)
+
+	response := SearchResponse{Facets: SearchFacets{
+		Topics: []FacetValue{{Value: "linux"}, {Value: "load balancing"}, {Value: "ssl"}},
+	}}
+	response.SetFacetLinks(form)
+	assert.True(t, response.Facets.Topics[0].Selected, "a topic given in another case is still selected")
+	assert.True(t, response.Facets.Topics[1].Selected)
+	assert.False(t, response.Facets.Topics[2].Selected)
+}
+
+func TestCustomFilters(t *testing.T) {
+	form, err := url.ParseQuery("custom.owner=jack&custom.owner=jill&custom.status=live&custom.=nothing")
+	assert.NoError(t, err)
+
+	filters, err := searchFilters(form, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{
+		"custom.owner":  {"jack", "jill"},
+		"custom.status": {"live"},
+	}, filters.Custom, "only form values naming a custom field should be filters")
+	assert.Len(t, filters.queries(time.Now()), 2, "each custom field should be a query")
+}
+
+func TestCustomDateFilters(t *testing.T) {
+	fields := []FieldSection{
+		{Metadata: "Owner", Type: fieldKeyword},
+		{Metadata: "Review-By", Field: "review", Type: fieldDate},
+	}
+	form, err := url.ParseQuery("custom.owner=jack&custom.review=2017-06-01&custom.review=2017-07-01..")
+	assert.NoError(t, err)
+
+	filters, err := searchFilters(form, fields)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{"custom.owner": {"jack"}}, filters.Custom)
+	if assert.Len(t, filters.CustomDates["custom.review"], 2) {
+		day := filters.CustomDates["custom.review"][0]
+		assert.Equal(t, "2017-06-01", day.start.Format("2006-01-02"))
+		assert.Equal(t, 24*time.Hour, day.end.Sub(day.start), "a date should match the whole day")
+		after := filters.CustomDates["custom.review"][1]
+		assert.Equal(t, "2017-07-01", after.start.Format("2006-01-02"))
+		assert.True(t, after.end.IsZero(), "a range without an end should be open")
+	}
+	assert.Len(t, filters.queries(time.Now()), 2, "each custom field should be a query")
+
+	for _, bad := range []string{"custom.review=someday", "custom.review=..", "custom.review=2017-06-01..later"} {
+		form, err = url.ParseQuery(bad)
+		assert.NoError(t, err)
+		_, err = searchFilters(form, fields)
+		assert.Error(t, err, "[%s] should be an error", bad)
+	}
+}
+
+func TestBuildFacets(t *testing.T) {
+	assert.Equal(t, SearchFacets{}, buildFacets(&bleve.SearchResult{}))
+
+	results := &bleve.SearchResult{
+		Facets: search.FacetResults{
+			"topic": &search.FacetResult{
+				Terms: search.TermFacets{
+					{Term: "linux", Count: 4},
+					{Term: "ssl", Count: 2},
+				},
+			},
+			"author": &search.FacetResult{
+				Terms: search.TermFacets{{Term: "jack", Count: 5}},
+			},
+			"modified": &search.FacetResult{
+				DateRanges: search.DateRangeFacets{
+					{Name: "year", Count: 5},
+					{Name: "week", Count: 1},
+				},
+			},
+		},
+	}
+
+	facets := buildFacets(results)
+	assert.Equal(t, []FacetValue{{Value: "linux", Count: 4}, {Value: "ssl", Count: 2}}, facets.Topics)
+	assert.Equal(t, []FacetValue{{Value: "jack", Count: 5}}, facets.Authors)
+	assert.Nil(t, facets.Keywords)
+	assert.Equal(t, []FacetValue{
+		{Value: "day", Count: 0},
+		{Value: "week", Count: 1},
+		{Value: "month", Count: 0},
+		{Value: "year", Count: 5},
+		{Value: "older", Count: 0},
+	}, facets.Modified, "date ranges should come back in order")
+}
+
+func TestSetFacetLinks(t *testing.T) {
+	form, err := url.ParseQuery("s=disk&topic=linux&modified=week&page=3")
+	assert.NoError(t, err)
+
+	response := SearchResponse{Facets: SearchFacets{
+		Topics:   []FacetValue{{Value: "linux"}, {Value: "ssl"}},
+		Modified: []FacetValue{{Value: "week"}, {Value: "year"}},
+	}}
+	response.SetFacetLinks(form)
+
+	assert.True(t, response.Facets.Topics[0].Selected)
+	assert.Equal(t, "?modified=week&s=disk", response.Facets.Topics[0].Link,
+		"a selected topic should link to the search without it")
+	assert.False(t, response.Facets.Topics[1].Selected)
+	assert.Equal(t, "?modified=week&s=disk&topic=linux&topic=ssl", response.Facets.Topics[1].Link,
+		"another topic should be added to the search")
+
+	assert.True(t, response.Facets.Modified[0].Selected)
+	assert.Equal(t, "?s=disk&topic=linux", response.Facets.Modified[0].Link)
+	assert.Equal(t, "?modified=year&s=disk&topic=linux", response.Facets.Modified[1].Link,
+		"only one range should be picked at a time")
+}
+
+func TestParseDate(t *testing.T) {
+	now := time.Date(2017, 3, 15, 12, 0, 0, 0, time.UTC)
+	var tests = []struct {
+		value    string
+		endOfDay bool
+		expected time.Time
+		valid    bool
+	}{
+		{"", false, time.Time{}, true},
+		{"2017-03-01", false, time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC), true},
+		{"2017-03-01", true, time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC), true},
+		{"2017-03-01T08:30", true, time.Date(2017, 3, 1, 8, 30, 0, 0, time.UTC), true},
+		{"2017-03-01T08:30:00Z", false, time.Date(2017, 3, 1, 8, 30, 0, 0, time.UTC), true},
+		{"7d", false, now.AddDate(0, 0, -7), true},
+		{"2w", false, now.AddDate(0, 0, -14), true},
+		{"1y", false, now.AddDate(0, 0, -365), true},
+		{"12h", false, now.Add(-12 * time.Hour), true},
+		{"90m", false, now.Add(-90 * time.Minute), true},
+		{"-7d", false, time.Time{}, false},
+		{"last week", false, time.Time{}, false},
+		{"2017-13-01", false, time.Time{}, false},
+	}
+
+	for _, testSet := range tests {
+		date, err := parseDate("since", testSet.value, now, testSet.endOfDay)
+		if !testSet.valid {
+			localError, ok := err.(*Error)
+			assert.True(t, ok, "[%q] did not get back my type of error", testSet.value)
+			if ok {
+				assert.Equal(t, ErrBadDate, localError.Code, "[%q] got the wrong error", testSet.value)
+			}
+			continue
+		}
+		assert.NoError(t, err, "[%q] should parse", testSet.value)
+		assert.True(t, testSet.expected.Equal(date),
+			"[%q] gave [%s] instead of [%s]", testSet.value, date, testSet.expected)
+	}
+}
+
+func TestSearchFiltersDates(t *testing.T) {
+	form, err := url.ParseQuery("since=2017-03-01&until=2017-03-10")
+	assert.NoError(t, err)
+	filters, err := searchFilters(form, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 2017, filters.Since.Year())
+	assert.Equal(t, 11, filters.Until.Day(), "a date-only until should include that day")
+	assert.Len(t, filters.queries(time.Now()), 1, "since and until should be one query")
+
+	form, err = url.ParseQuery("since=yesterday")
+	assert.NoError(t, err)
+	_, err = searchFilters(form, nil)
+	assert.Error(t, err, "a bad since should be an error")
+}
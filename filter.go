@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// the file in the root of each WatchDir listing globs to not index
+const ignoreFileName = ".gokiignore"
+
+// fileFilter decides which files under a WatchDir get indexed. The crawl and
+//  the watcher share one per WatchDir, so both skip the same files.
+type fileFilter struct {
+	root       string
+	extensions []string
+	hidden     bool
+	maxSize    int64
+	lock       sync.RWMutex
+	ignores    []string
+}
+
+func newFileFilter(c IndexSection, root string) (*fileFilter, error) {
+	f := &fileFilter{
+		root:       filepath.Clean(root),
+		extensions: splitExtensions(c.WatchExtension),
+		hidden:     c.IndexHidden,
+		maxSize:    c.MaxFileSize,
+	}
+	if err := f.loadIgnores(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// splitExtensions splits a list of extensions separated by commas or spaces
+func splitExtensions(list string) []string {
+	var extensions []string
+	for _, ext := range strings.FieldsFunc(list, func(r rune) bool {
+		return r == ',' || r == ' '
+	}) {
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		extensions = append(extensions, ext)
+	}
+	return extensions
+}
+
+// loadIgnores reads the ignore file in the root, if there is one. Each line
+//  is a glob - blank lines and lines starting with # are skipped.
+func (f *fileFilter) loadIgnores() error {
+	var ignores []string
+
+	file, err := os.Open(filepath.Join(f.root, ignoreFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return &Error{Code: ErrFileRead, value: f.root, innerError: err}
+	} else if err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			if _, err := filepath.Match(line, ""); err != nil {
+				return &Error{Code: ErrBadIgnore, value: line, innerError: err}
+			}
+			ignores = append(ignores, strings.TrimSuffix(line, "/"))
+		}
+		if err := scanner.Err(); err != nil {
+			return &Error{Code: ErrFileRead, value: f.root, innerError: err}
+		}
+	}
+
+	f.lock.Lock()
+	f.ignores = ignores
+	f.lock.Unlock()
+	return nil
+}
+
+// ignored checks a path relative to the root against the ignore globs. A
+//  glob with a / is matched against the whole relative path, and any other
+//  glob against each piece of the path.
+func (f *fileFilter) ignored(rel string) bool {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	pieces := strings.Split(rel, "/")
+	for _, pattern := range f.ignores {
+		if strings.Contains(pattern, "/") {
+			if matched, _ := filepath.Match(strings.TrimPrefix(pattern, "/"), rel); matched {
+				return true
+			}
+			continue
+		}
+		for _, piece := range pieces {
+			if matched, _ := filepath.Match(pattern, piece); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// skip checks if a file or directory should not be indexed or watched
+func (f *fileFilter) skip(path string, info os.FileInfo) bool {
+	rel, err := filepath.Rel(f.root, path)
+	if err != nil || rel == "." {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+
+	if !f.hidden {
+		for _, piece := range strings.Split(rel, "/") {
+			if strings.HasPrefix(piece, ".") {
+				return true
+			}
+		}
+	}
+
+	if f.ignored(rel) {
+		return true
+	}
+
+	if info == nil || info.IsDir() {
+		return false
+	}
+
+	if filepath.Base(path) == ignoreFileName {
+		return true
+	}
+
+	if f.maxSize > 0 && info.Size() > f.maxSize {
+		return true
+	}
+
+	if len(f.extensions) == 0 {
+		return false
+	}
+	for _, ext := range f.extensions {
+		if filepath.Ext(path) == ext {
+			return false
+		}
+	}
+	return true
+}
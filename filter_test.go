@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeFileInfo lets the filter be tested without files on disk
+type fakeFileInfo struct {
+	name  string
+	size  int64
+	isDir bool
+}
+
+func (f fakeFileInfo) Name() string       { return f.name }
+func (f fakeFileInfo) Size() int64        { return f.size }
+func (f fakeFileInfo) Mode() os.FileMode  { return 0644 }
+func (f fakeFileInfo) ModTime() time.Time { return time.Time{} }
+func (f fakeFileInfo) IsDir() bool        { return f.isDir }
+func (f fakeFileInfo) Sys() interface{}   { return nil }
+
+func TestSplitExtensions(t *testing.T) {
+	var tests = []struct {
+		input    string
+		expected []string
+	}{
+		{"", nil},
+		{".md", []string{".md"}},
+		{"md", []string{".md"}},
+		{".md,.markdown", []string{".md", ".markdown"}},
+		{".md, .markdown txt", []string{".md", ".markdown", ".txt"}},
+	}
+	for _, testSet := range tests {
+		assert.Equal(t, testSet.expected, splitExtensions(testSet.input),
+			"[%q] split wrong", testSet.input)
+	}
+}
+
+func TestFileFilterSkip(t *testing.T) {
+	root, err := ioutil.TempDir("", "fileFilter.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	ignores := "# comment line\n\n*.swp\ndrafts/\narchive/old-*.md\n"
+	err = ioutil.WriteFile(filepath.Join(root, ignoreFileName), []byte(ignores), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := newFileFilter(IndexSection{WatchExtension: ".md", MaxFileSize: 1024}, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		path     string
+		info     fakeFileInfo
+		expected bool
+	}{
+		{"page.md", fakeFileInfo{size: 10}, false},
+		{"sub/page.md", fakeFileInfo{size: 10}, false},
+		{"image.png", fakeFileInfo{size: 10}, true},
+		{"big.md", fakeFileInfo{size: 2048}, true},
+		{".git", fakeFileInfo{isDir: true}, true},
+		{".git/HEAD", fakeFileInfo{size: 10}, true},
+		{"sub/.page.md.swp", fakeFileInfo{size: 10}, true},
+		{"page.md.swp", fakeFileInfo{size: 10}, true},
+		{"drafts", fakeFileInfo{isDir: true}, true},
+		{"sub/drafts/page.md", fakeFileInfo{size: 10}, true},
+		{"archive/old-page.md", fakeFileInfo{size: 10}, true},
+		{"archive/new-page.md", fakeFileInfo{size: 10}, false},
+		{"sub", fakeFileInfo{isDir: true}, false},
+		{".", fakeFileInfo{isDir: true}, false},
+	}
+	for _, testSet := range tests {
+		assert.Equal(t, testSet.expected, f.skip(filepath.Join(root, testSet.path), testSet.info),
+			"[%q] was filtered wrong", testSet.path)
+	}
+
+	f.hidden = true
+	assert.False(t, f.skip(filepath.Join(root, ".hidden", "page.md"), fakeFileInfo{size: 10}),
+		"hidden files should be allowed")
+	assert.True(t, f.skip(filepath.Join(root, ignoreFileName), fakeFileInfo{size: 10}),
+		"the ignore file should never be indexed")
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// the lines that open and close each kind of front matter
+const (
+	yamlFence = "---"
+	tomlFence = "+++"
+)
+
+// the names each piece of metadata can be given in a page's header, and the
+//  piece of metadata each is
+var metaAliases = map[string]string{
+	"title":      "title",
+	"topic":      "topic",
+	"topics":     "topic",
+	"tag":        "topic",
+	"tags":       "topic",
+	"category":   "topic",
+	"categories": "topic",
+	"keyword":    "keyword",
+	"keywords":   "keyword",
+	"author":     "author",
+	"authors":    "author",
+	"access":     "access",
+}
+
+// a mail style header line, such as "Topic: linux" - the name is followed by
+//  a space or the end of the line, so a page starting with a link is not one
+var headerLine = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]*[ \t]*:([ \t]|$)`)
+
+// splitFrontMatter splits a page into its metadata and its body. The
+//  metadata is YAML between --- lines, TOML between +++ lines, or mail style
+//  headers ending at the first blank line. Mail style headers are only taken
+//  as metadata if the first line is one and every line up to the blank line
+//  parses as one, the same as net/mail - any name is kept. A page may have no
+//  metadata at all. Metadata keys are lower cased.
+func splitFrontMatter(contents []byte) (map[string][]string, []byte, error) {
+	contents = bytes.TrimPrefix(contents, []byte("\xef\xbb\xbf"))
+	firstLine := contents
+	if end := bytes.IndexByte(contents, '\n'); end >= 0 {
+		firstLine = contents[:end]
+	}
+	firstLine = bytes.TrimRight(firstLine, " \t\r")
+
+	switch {
+	case string(firstLine) == yamlFence:
+		lines, body, ok := fencedLines(contents, yamlFence, "...")
+		if ok {
+			var raw map[string]interface{}
+			if err := yaml.Unmarshal([]byte(strings.Join(lines, "\n")), &raw); err != nil {
+				return nil, nil, &Error{Code: ErrBadFrontMatter, path: "yaml", innerError: err}
+			}
+			meta, err := frontMatterValues("yaml", raw)
+			return meta, body, err
+		}
+	case string(firstLine) == tomlFence:
+		lines, body, ok := fencedLines(contents, tomlFence)
+		if ok {
+			var raw map[string]interface{}
+			if _, err := toml.Decode(strings.Join(lines, "\n"), &raw); err != nil {
+				return nil, nil, &Error{Code: ErrBadFrontMatter, path: "toml", innerError: err}
+			}
+			meta, err := frontMatterValues("toml", raw)
+			return meta, body, err
+		}
+	case len(firstLine) == 0 || headerLine.Match(firstLine):
+		parsed, err := mail.ReadMessage(bytes.NewReader(contents))
+		if err != nil {
+			// not headers after all, just a page that starts like one
+			break
+		}
+		meta := make(map[string][]string)
+		for key, values := range parsed.Header {
+			meta[strings.ToLower(key)] = values
+		}
+		body := new(bytes.Buffer)
+		if _, err := body.ReadFrom(parsed.Body); err != nil {
+			return nil, nil, err
+		}
+		return meta, body.Bytes(), nil
+	}
+
+	return map[string][]string{}, contents, nil
+}
+
+// fencedLines gives the lines between the opening fence on the first line
+//  and the closing fence, and the body after it. It is not ok if the fence is
+//  never closed.
+func fencedLines(contents []byte, fence string, closers ...string) ([]string, []byte, bool) {
+	closers = append(closers, fence)
+	lines := strings.SplitAfter(string(contents), "\n")
+	offset := len(lines[0])
+	for id, line := range lines[1:] {
+		trimmed := strings.TrimRight(line, " \t\r\n")
+		for _, closer := range closers {
+			if trimmed == closer {
+				var inside []string
+				for _, each := range lines[1 : id+1] {
+					inside = append(inside, strings.TrimRight(each, "\r\n"))
+				}
+				return inside, contents[offset+len(line):], true
+			}
+		}
+		offset += len(line)
+	}
+	return nil, nil, false
+}
+
+// frontMatterValues turns decoded YAML or TOML front matter into lists of
+//  strings, keyed by the lower cased key. A value may be a single value or a
+//  list of them - anything nested deeper is an error, rather than being
+//  quietly dropped.
+func frontMatterValues(format string, raw map[string]interface{}) (map[string][]string, error) {
+	meta := make(map[string][]string)
+	for key, value := range raw {
+		key = strings.ToLower(key)
+		switch v := value.(type) {
+		case nil:
+			meta[key] = nil
+		case []interface{}:
+			for _, each := range v {
+				s, ok := scalarString(each)
+				if !ok {
+					return nil, &Error{Code: ErrBadFrontMatter, path: format,
+						value: fmt.Sprintf("[%s] is a list of lists or tables", key)}
+				}
+				meta[key] = append(meta[key], s)
+			}
+		default:
+			s, ok := scalarString(v)
+			if !ok {
+				return nil, &Error{Code: ErrBadFrontMatter, path: format,
+					value: fmt.Sprintf("[%s] is nested", key)}
+			}
+			meta[key] = []string{s}
+		}
+	}
+	return meta, nil
+}
+
+// scalarString gives a single front matter value as a string. It is not ok
+//  if the value is a map, table, or list.
+func scalarString(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return strings.TrimSpace(v), true
+	case time.Time:
+		if v.Equal(v.Truncate(24 * time.Hour)) {
+			return v.Format("2006-01-02"), true
+		}
+		return v.Format(time.RFC3339), true
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprint(v), true
+	}
+	return "", false
+}
+
+// pageCustom gives the metadata that is not under any of the metaAliases,
+//  leaving out keys without a value
+func pageCustom(meta map[string][]string) map[string][]string {
+	custom := make(map[string][]string)
+	for key, values := range meta {
+		if _, ok := metaAliases[key]; !ok && len(values) > 0 {
+			custom[key] = values
+		}
+	}
+	return custom
+}
+
+// pageMeta gathers the values of each piece of metadata, under any of its
+//  names
+func pageMeta(meta map[string][]string) map[string][]string {
+	gathered := make(map[string][]string)
+	for key, values := range meta {
+		if name, ok := metaAliases[key]; ok {
+			gathered[name] = append(gathered[name], values...)
+		}
+	}
+	return gathered
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitFrontMatter(t *testing.T) {
+	var tests = []struct {
+		input string
+		meta  map[string][]string
+		body  string
+	}{
+		{
+			"---\ntitle: \"Disk: Usage\"\nTags:\n  - linux\n  - 'file systems'\nkeywords: [disk, \"full, again\"]\n" +
+				"author: jack # the usual\nreview: 2017-06-01\nsummary: >\n  a long\n  summary\nsteps: |\n  one\n  two\n" +
+				"draft:\n---\nbody\n",
+			map[string][]string{
+				"title":    {"Disk: Usage"},
+				"tags":     {"linux", "file systems"},
+				"keywords": {"disk", "full, again"},
+				"author":   {"jack"},
+				"review":   {"2017-06-01"},
+				"summary":  {"a long summary"},
+				"steps":    {"one\ntwo"},
+				"draft":    nil,
+			},
+			"body\n",
+		},
+		{
+			"+++\ntitle = \"Disk Usage\"\ntags = [\n  \"linux\",\n  \"ssl\",\n]\ndraft = false\nweight = 3\n" +
+				"notes = \"\"\"\nfirst\nsecond\"\"\"\n+++\nbody",
+			map[string][]string{
+				"title":  {"Disk Usage"},
+				"tags":   {"linux", "ssl"},
+				"draft":  {"false"},
+				"weight": {"3"},
+				"notes":  {"first\nsecond"},
+			},
+			"body",
+		},
+		{
+			"Title: Mail Style\nTopic: linux\nTopic: ssl\n\nbody",
+			map[string][]string{
+				"title": {"Mail Style"},
+				"topic": {"linux", "ssl"},
+			},
+			"body",
+		},
+		{
+			"# Just Markdown\n\nbody",
+			map[string][]string{},
+			"# Just Markdown\n\nbody",
+		},
+		{
+			"Note: this looks like a header\nbut it is not\n",
+			map[string][]string{},
+			"Note: this looks like a header\nbut it is not\n",
+		},
+		{
+			"Title: Runbook\nTopic: Internal\nAccess: ops\nStatus: draft\n\nbody",
+			map[string][]string{
+				"title":  {"Runbook"},
+				"topic":  {"Internal"},
+				"access": {"ops"},
+				"status": {"draft"},
+			},
+			"body",
+		},
+		{
+			"https://example.com is where this started\n\nbody",
+			map[string][]string{},
+			"https://example.com is where this started\n\nbody",
+		},
+	}
+
+	for _, testSet := range tests {
+		meta, body, err := splitFrontMatter([]byte(testSet.input))
+		assert.NoError(t, err, "[%q] should parse", testSet.input)
+		assert.Equal(t, testSet.meta, meta, "[%q] got the wrong metadata", testSet.input)
+		assert.Equal(t, testSet.body, string(body), "[%q] got the wrong body", testSet.input)
+	}
+
+	var bad = []struct {
+		input  string
+		reason string
+	}{
+		{"---\njust words\n---\nbody", "YAML that is not a map"},
+		{"---\ntitle: [unclosed\n---\nbody", "YAML that does not parse"},
+		{"---\nparams:\n  nested: value\n---\nbody", "a nested YAML map"},
+		{"---\ntags:\n  - [a, b]\n---\nbody", "a YAML list of lists"},
+		{"+++\ntags = [\"never closed\"\n+++\nbody", "an unclosed TOML list"},
+		{"+++\ntitle = \"x\"\n[params]\nauthor = \"nobody\"\n+++\nbody", "a TOML table"},
+		{"+++\n[[links]]\nname = \"a\"\n[[links]]\nname = \"b\"\n+++\nbody", "a TOML array of tables"},
+	}
+	for _, testSet := range bad {
+		_, _, err := splitFrontMatter([]byte(testSet.input))
+		assert.Error(t, err, "%s should be an error", testSet.reason)
+	}
+}
+
+func TestPageMeta(t *testing.T) {
+	meta := pageMeta(map[string][]string{
+		"tags":       {"linux"},
+		"categories": {"ops"},
+		"authors":    {"jack"},
+		"draft":      {"true"},
+	})
+	assert.Equal(t, map[string][]string{
+		"topic":  {"linux", "ops"},
+		"author": {"jack"},
+	}, sortedMeta(meta))
+}
+
+func TestPageCustom(t *testing.T) {
+	assert.Equal(t, map[string][]string{
+		"owner":     {"ops"},
+		"review-by": {"2017-06-01"},
+	}, pageCustom(map[string][]string{
+		"title":     {"Disk Usage"},
+		"tags":      {"linux"},
+		"owner":     {"ops"},
+		"review-by": {"2017-06-01"},
+		"params":    nil,
+	}), "aliased metadata and keys without values should be left out")
+}
+
+// sortedMeta puts the values of each key in order, since aliases are gathered
+//  from a map
+func sortedMeta(meta map[string][]string) map[string][]string {
+	for _, values := range meta {
+		for a := range values {
+			for b := a + 1; b < len(values); b++ {
+				if values[b] < values[a] {
+					values[a], values[b] = values[b], values[a]
+				}
+			}
+		}
+	}
+	return meta
+}
@@ -1,61 +1,150 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"log"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"os"
 
 	"net/http"
 
 	"flag"
-
-	"github.com/gorilla/handlers"
 )
 
 var configFile = flag.String("config", "config.json", "specify a configuration file")
+var checkLinks = flag.Bool("check-links", false,
+	"check the links in every page against the config, then exit - non-zero if any are broken")
+var shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second,
+	"how long to wait for in-flight requests when shutting down")
 
 var quitChan = make(chan os.Signal, 1)
 
-// func cleanup() {
-// 	_ = <-quitChan
-// 	log.Println("Recieved an interrupt, shutting down")
-// 	for _, index := range indexes {
-// 		index.CloseIndex()
-// 	}
-// 	os.Exit(0)
-// }
+// shutdown waits for an interrupt, then gracefully stops all of the given
+//  servers. done is closed once every server has finished draining.
+func shutdown(done chan<- struct{}, servers ...*http.Server) {
+	sig := <-quitChan
+	log.Printf("Recieved %s, shutting down", sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				log.Printf("failed to shut down [%s] cleanly - %v", server.Addr, err)
+			}
+		}(server)
+	}
+	wg.Wait()
+	close(done)
+}
+
+// runLinkCheck reads the config, checks the links of every page on disk,
+//  prints any broken ones, and exits
+func runLinkCheck() {
+	config, err := ReadConfig(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	report, err := CheckLinks(*config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := report.Write(os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+	if report.Broken > 0 {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
 
 func main() {
 	flag.Parse()
+	if *checkLinks {
+		runLinkCheck()
+	}
 
-	// ##TODO## check for false returnear- if null, the config could not be loaded
-	if err := LoadConfig(*configFile); err != nil {
+	closer := make(chan struct{})
+	indexesClosed := new(sync.WaitGroup)
+	logs := log.New(os.Stdout, "", 0)
+
+	// the reloader does the first load of the config, templates, and muxer
+	indexes := NewIndexSet(closer, indexesClosed, logs)
+	handler := new(SwappableHandler)
+	reloader := NewReloader(*configFile, handler, indexes, logs)
+	if err := reloader.Reload(); err != nil {
+		close(closer)
+		indexesClosed.Wait()
 		log.Fatal(err)
 	}
-
 	config := GetConfig()
-	closer := make(chan struct{})
 
-	// set up my interrupt channel and go routine
-	// signal.Notify(quitChan, os.Interrupt)
-	// go func() {
-	// 	<-closer
-	// 	<-quitChan
-	// 	close(closer)
-	// }()
+	go func() {
+		if err := reloader.Watch(closer); err != nil {
+			log.Println(err)
+		}
+	}()
 
-	if err := ParseTemplates(*config); err != nil {
-		log.Fatalf("Error parsing templates, %s", err)
+	server := &http.Server{
+		Addr:    config.Address + ":" + config.Port,
+		Handler: handler,
+	}
+	servers := []*http.Server{server}
+
+	useTLS := config.CertFile != "" && config.KeyFile != ""
+	if useTLS {
+		certs, err := newCertLoader(config.CertFile, config.KeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.TLSConfig = &tls.Config{GetCertificate: certs.GetCertificate}
+
+		if config.RedirectPort != "" {
+			redirectServer := &http.Server{
+				Addr:    config.Address + ":" + config.RedirectPort,
+				Handler: redirectToHTTPS(config.Port),
+			}
+			servers = append(servers, redirectServer)
+			go func() {
+				err := redirectServer.ListenAndServe()
+				if err != http.ErrServerClosed {
+					log.Println(err)
+				}
+			}()
+		}
 	}
 
-	mux, err := BuildMuxer(*config, closer, log.New(os.Stdout, "", 0))
-	if err != nil {
-		log.Fatal(err)
+	// set up my interrupt channel and go routine
+	drained := make(chan struct{})
+	signal.Notify(quitChan, os.Interrupt, syscall.SIGTERM)
+	go shutdown(drained, servers...)
+
+	var err error
+	if useTLS {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
 	}
 
-	mux = handlers.LoggingHandler(os.Stdout, mux)
-	canonical := handlers.CanonicalHost(config.Hostname, http.StatusMovedPermanently)
+	if err == http.ErrServerClosed {
+		<-drained
+	}
 
-	log.Println(http.ListenAndServe(config.Address+":"+config.Port, canonical(mux)))
-	// log.Printf("\n\n#############\n[%s]\n############\n\n", filePath)
+	// close every index, and wait on the watchers to finish
+	close(closer)
+	indexesClosed.Wait()
+	if err != http.ErrServerClosed {
+		// the server never came up, or died - exit so it is noticed
+		log.Fatal(err)
+	}
+	log.Println("all indexes closed, exiting")
 }
@@ -1,27 +1,54 @@
 package main
 
 import (
+	"encoding/json"
 	"html/template"
 	"io"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"strconv"
-
-	"github.com/ajg/form"
+	"strings"
 )
 
 // FieldsHandler is a standard handler that pulls the first folder of the
 //  response, and lists that topic or author. If there is none, it falls back to
-//  listing all topics or authors with the fallback template.
+//  listing all topics or authors with the fallback template. A custom field
+//  is listed the same way, with all of its values in Values.
 type FieldsHandler struct {
 	c ServerSection
 	i Index
+	a *accessControl
+	f []FieldSection // the custom fields of the index
 }
 
 func (h FieldsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	visible := SearchFilters{Viewer: h.a.viewer(r)}
+	if r.URL.Path == "" && strings.HasPrefix(h.c.Default, customPrefix) {
+		values, err := ListField(h.i, h.c.Default, visible)
+		if err != nil {
+			http.Error(w, "failed to list "+h.c.Default, http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		template := h.c.FallbackTemplate
+		if template == "" {
+			template = h.c.Template
+		}
+		writeResponse(w, r, template, SearchResponse{Values: values})
+		return
+	}
+
 	// fields := strings.SplitN(r.URL.Path, "/", 2)
 
 	// if len(fields) < 2 || fields[1] == "" {
@@ -29,31 +56,37 @@ func (h FieldsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// to do if a field was not given
 		switch h.c.FallbackTemplate {
 		case "":
-			FallbackSearchResponse(h.i, w, h.c.Template)
+			FallbackSearchResponse(h.i, w, r, h.c.Template, visible)
 		default:
-			FallbackSearchResponse(h.i, w, h.c.FallbackTemplate)
+			FallbackSearchResponse(h.i, w, r, h.c.FallbackTemplate, visible)
 		}
 		return
 	}
 
 	// to be done if a field was given - might actually have to be 1 idk
-	// results, err := ListAllField(h.i, h.c.Default, fields[0], 100, 1)
-	results, err := ListAllField(h.i, h.c.Default, r.URL.Path, 100, 1)
+	opts, err := searchOptions(h.c, h.f, r.Form)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	opts.Viewer = visible.Viewer
 
-	err = allTemplates.ExecuteTemplate(w, h.c.Template, results)
+	results, err := ListAllField(h.i, h.c.Default, r.URL.Path, opts)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	results.SetLinks(r.Form)
+
+	writeResponse(w, r, h.c.Template, results)
 }
 
 // FuzzySearch is a normal search format - it should provide a point and click interface to allow searching.
 type FuzzyHandler struct {
 	c ServerSection
 	i Index
+	a *accessControl
+	f []FieldSection // the custom fields of the index
 }
 
 func (h FuzzyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -68,36 +101,23 @@ func (h FuzzyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if _, ok := r.Form["s"]; ok && len(r.Form["s"]) > 0 {
 		values.Term = r.Form["s"][0]
 	}
-	if _, ok := r.Form["topic"]; ok && len(r.Form["topic"]) > 0 {
-		values.Topics = r.Form["topic"]
-	}
-	if _, ok := r.Form["author"]; ok && len(r.Form["author"]) > 0 {
-		values.Authors = r.Form["author"]
-	}
-
-	if _, ok := r.Form["page"]; ok && len(r.Form["page"]) > 0 {
-		i, err := strconv.Atoi(r.Form["page"][0])
-		if err == nil {
-			values.Page = i
-		}
-	}
-	if _, ok := r.Form["pageSize"]; ok && len(r.Form["pageSize"]) > 0 {
-		i, err := strconv.Atoi(r.Form["pageSize"][0])
-		if err == nil {
-			values.Page = i
-		}
+	values.SearchOptions, err = searchOptions(h.c, h.f, r.Form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
+	values.Viewer = h.a.viewer(r)
+	values.Boosts = h.c.Boosts
+	values.Fuzziness = h.c.Fuzziness
 
 	results, err := FuzzySearch(h.i, values)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	results.SetLinks(r.Form)
 
-	err = allTemplates.ExecuteTemplate(w, h.c.Template, results)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
+	writeResponse(w, r, h.c.Template, results)
 }
 
 // QuerySearchHAndler is a handler that uses a custom search format to do
@@ -105,54 +125,306 @@ func (h FuzzyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 type QueryHandler struct {
 	c ServerSection
 	i Index
+	a *accessControl
+	f []FieldSection // the custom fields of the index
 }
 
 func (h QueryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	values := struct {
-		s        string `form:"s"`
-		page     int    `form:"page"`
-		pageSize int    `form:"pageSize"`
-	}{}
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	if r.Method != http.MethodPost {
+	viewer := h.a.viewer(r)
+	terms := r.Form.Get("s")
+	if terms == "" {
 		// to do if a field was not given
-		FallbackSearchResponse(h.i, w, h.c.FallbackTemplate)
+		FallbackSearchResponse(h.i, w, r, h.c.FallbackTemplate, SearchFilters{Viewer: viewer})
+		return
+	}
+
+	opts, err := searchOptions(h.c, h.f, r.Form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts.Viewer = viewer
+
+	results, err := QuerySearch(h.i, terms, opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	results.SetLinks(r.Form)
+
+	writeResponse(w, r, h.c.Template, results)
+}
 
+// searchOptions reads the filters and page to search for out of the form
+//  values, along with the handler's settings for the search
+func searchOptions(c ServerSection, fields []FieldSection, form url.Values) (SearchOptions, error) {
+	filters, err := searchFilters(form, fields)
+	if err != nil {
+		return SearchOptions{}, err
+	}
+
+	opts := SearchOptions{
+		SearchFilters: filters,
+		SnippetLength: c.SnippetLength,
+		Sort:          c.Sort,
+	}
+	if sort := form.Get("sort"); validSort(sort) {
+		opts.Sort = sort
+	}
+	opts.Page, opts.PageSize = pageValues(c, form)
+	return opts, nil
+}
+
+// pageValues reads the page and pageSize form values, falling back to the
+//  first page and the handler's PageSize, and keeping the size under the
+//  handler's MaxPageSize and the page within maxResultWindow.
+func pageValues(c ServerSection, form url.Values) (page, pageSize int) {
+	maxPageSize := c.MaxPageSize
+	if maxPageSize < 1 {
+		maxPageSize = defaultMaxPageSize
+	}
+	pageSize = c.PageSize
+	if pageSize < 1 {
+		pageSize = defaultPageSize
+	}
+
+	if i, err := strconv.Atoi(form.Get("pageSize")); err == nil && i > 0 {
+		pageSize = i
+	}
+	if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+
+	page = 1
+	if i, err := strconv.Atoi(form.Get("page")); err == nil && i > 0 {
+		page = i
+	}
+	if page > lastPage(pageSize) {
+		page = lastPage(pageSize)
+	}
+	return page, pageSize
+}
+
+// RecentHandler lists the most recently modified pages in the index, newest
+//  first. It takes the same filters as the search handlers.
+type RecentHandler struct {
+	c ServerSection
+	i Index
+	a *accessControl
+	f []FieldSection // the custom fields of the index
+}
+
+func (h RecentHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	err = form.DecodeValues(&values, r.Form)
+	opts, err := searchOptions(h.c, h.f, r.Form)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if values.s == "" {
-		// to do if a field was not given
-		FallbackSearchResponse(h.i, w, h.c.FallbackTemplate)
+
+	opts.Viewer = h.a.viewer(r)
+	results, err := RecentChanges(h.i, opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	results.SetLinks(r.Form)
+	// always newest first, so there is no other order to offer
+	results.Sorts = nil
 
-	results, err := QuerySearch(h.i, values.s, values.page, values.pageSize)
+	writeResponse(w, r, h.c.Template, results)
+}
+
+// LinkReportHandler lists every page in the index with links that go
+//  nowhere, checked against the handlers and WatchDirs in the config. Only
+//  the pages the viewer may see are listed.
+type LinkReportHandler struct {
+	c ServerSection
+	i Index
+	a *accessControl
+}
+
+func (h LinkReportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	config := GetConfig()
+	if config == nil {
+		http.Error(w, "no config loaded", http.StatusInternalServerError)
+		return
+	}
+
+	report, err := BrokenLinkReport(h.i, *config, h.a.viewer(r))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	err = allTemplates.ExecuteTemplate(w, h.c.Template, results)
+	writeResponse(w, r, h.c.Template, report)
+}
+
+// wantsJSON checks if a request asked for json instead of a template, either
+//  with ?format=json or with an Accept header of application/json
+func wantsJSON(r *http.Request) bool {
+	if r.FormValue("format") == "json" {
+		return true
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err == nil && mediaType == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+// writeResponse writes data as json if the request asked for it, and
+//  otherwise renders it with the named template
+func writeResponse(w http.ResponseWriter, r *http.Request, template string,
+	data interface{}) {
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(data); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	err := RenderTemplate(w, template, data)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
+// AdminHandler shows the status of an index, and allows the index to be
+//  rebuilt or a single URI to be reindexed. It is always wrapped in a login.
+//  * GET / gives the IndexStats
+//  * POST /rebuild wipes and recrawls the index in the background
+//  * POST /reindex indexes the page at the form value uri again
+type AdminHandler struct {
+	c ServerSection
+	i Index
+}
+
+func (h AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.i == nil {
+		http.Error(w, "no index for this handler", http.StatusNotFound)
+		return
+	}
+
+	switch r.URL.Path {
+	case "", "status":
+		h.writeStatus(w, http.StatusOK)
+	case "rebuild":
+		if r.Method != http.MethodPost {
+			http.Error(w, "rebuild must be a POST", http.StatusMethodNotAllowed)
+			return
+		}
+		err := h.i.Rebuild()
+		if e, ok := err.(*Error); ok && e.Code == ErrRebuildRunning {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		h.writeStatus(w, http.StatusAccepted)
+	case "reindex":
+		if r.Method != http.MethodPost {
+			http.Error(w, "reindex must be a POST", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		uri := r.Form.Get("uri")
+		if uri == "" {
+			http.Error(w, "no uri given to reindex", http.StatusBadRequest)
+			return
+		}
+		err := h.i.ReindexURI(path.Clean("/" + uri))
+		if e, ok := err.(*Error); ok && e.Code == ErrNoFileForURI {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		h.writeStatus(w, http.StatusOK)
+	default:
+		http.Error(w, "Page not Found", http.StatusNotFound)
+	}
+}
+
+// writeStatus renders the IndexStats with the template, or as JSON if there
+//  is no template
+func (h AdminHandler) writeStatus(w http.ResponseWriter, code int) {
+	stats := h.i.Stats()
+
+	if h.c.Template == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		if err := json.NewEncoder(w).Encode(stats); err != nil {
+			log.Print(err)
+		}
+		return
+	}
+
+	if code != http.StatusOK {
+		w.WriteHeader(code)
+	}
+	if err := RenderTemplate(w, h.c.Template, stats); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 // RawFile is a http.Handler that serves a raw file back, restricting by file
-//  extension if necessary and adding approipate mime-types.
+//  extension if necessary and adding approipate mime-types. The source of a
+//  markdown page is only served to the users who may see the page.
 type RawFile struct {
 	c ServerSection
+	a *accessControl
+}
+
+// governingPage gives the page whose groups decide who may see a file - the
+//  file itself for a page, or for anything else the index.md of the nearest
+//  directory above it within the handler's Path. Without one, an empty page
+//  is given, which everyone may see.
+func (h RawFile) governingPage(rel string) (*PageMetadata, error) {
+	rel = path.Clean("/" + rel)
+	pagePath := ""
+	if path.Ext(rel) == ".md" {
+		pagePath = filepath.Join(h.c.Path, filepath.FromSlash(rel))
+	} else {
+		for dir := path.Dir(rel); ; dir = path.Dir(dir) {
+			index := filepath.Join(h.c.Path, filepath.FromSlash(dir), directoryIndex)
+			if isFile(index) {
+				pagePath = index
+				break
+			}
+			if dir == "/" {
+				break
+			}
+		}
+	}
+
+	pdata := new(PageMetadata)
+	if pagePath == "" {
+		return pdata, nil
+	}
+	if err := pdata.LoadPage(pagePath); err != nil {
+		return nil, err
+	}
+	return pdata, nil
 }
 
 func (h RawFile) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -170,6 +442,21 @@ func (h RawFile) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if h.a != nil && isFile(filepath.Join(h.c.Path, r.URL.Path)) {
+		viewer := h.a.viewer(r)
+		pdata, err := h.governingPage(r.URL.Path)
+		if err != nil {
+			// the groups can not be known, so nobody gets in
+			log.Printf("request [ %s ] could not be checked - %v", r.URL.Path, err)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if !h.a.allowed(viewer, pdata) {
+			h.a.deny(w, r, viewer)
+			return
+		}
+	}
+
 	f, err := os.Open(filepath.Join(h.c.Path, r.URL.Path))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusForbidden)
@@ -207,17 +494,67 @@ type Page struct {
 	Topics   []string
 	Keywords []string
 	Authors  []string
+	// Custom is the page's other metadata, keyed by lower cased name
+	Custom map[string][]string
+	// Backlinks are the pages that link to this one, if there is an index
+	Backlinks []Backlink
+	// Related are the pages most like this one, if there is an index
+	Related []RelatedPage
+	// Breadcrumbs are the directories above this page, from the top down
+	Breadcrumbs []Breadcrumb
 }
 
 // Markdown is an http.Handler that renders a markdown file and serves it back.
 //  Author and Topic tags before the first major title are parsed and displayed.
-//  It is possible to restrict access to a page based on topic tag.
+//  It is possible to restrict access to a page based on topic tag, or to only
+//  show it to some groups of users. If the handler has an index, the pages
+//  linking to this one and the pages most like it are listed as well. A
+//  directory is served with its index.md, or a listing of what is in it.
 type Markdown struct {
-	c ServerSection
+	c       ServerSection
+	i       Index
+	related *relatedCache
+	a       *accessControl
 }
 
 func (h Markdown) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	defaultPage(h.c.Default, appendExtension(".md", h.backendServe())).ServeHTTP(w, r)
+	defaultPage(h.c.Default,
+		h.directoryServe(appendExtension(".md", h.backendServe()))).ServeHTTP(w, r)
+}
+
+// directoryServe serves a request for a directory with the index.md in it.
+//  Without one, the directory is listed with the ListTemplate - if that
+//  is not set, it is not found. A page with the same name as a directory
+//  wins over the directory.
+func (h Markdown) directoryServe(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dirPath := filepath.Join(h.c.Path, r.URL.Path)
+		info, err := os.Stat(dirPath)
+		if err != nil || !info.IsDir() || isFile(dirPath+".md") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if isFile(filepath.Join(dirPath, directoryIndex)) {
+			r.URL.Path = path.Join(r.URL.Path, directoryIndex)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if h.c.ListTemplate == "" {
+			log.Printf("request [ %s ] is a directory without an index", r.URL.Path)
+			http.Error(w, "Page not Found", http.StatusNotFound)
+			return
+		}
+
+		listing, err := h.listDirectory(r.URL.Path, h.a.viewer(r))
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Page not Found", http.StatusNotFound)
+			return
+		}
+		writeResponse(w, r, h.c.ListTemplate, listing)
+	})
 }
 
 func (h Markdown) backendServe() http.Handler {
@@ -240,22 +577,49 @@ func (h Markdown) backendServe() http.Handler {
 			return
 		}
 
+		viewer := h.a.viewer(r)
+		if !h.a.allowed(viewer, pdata) {
+			h.a.deny(w, r, viewer)
+			return
+		}
+
 		// parse any markdown in the input
-		body := template.HTML(bodyParseMarkdown(pdata.Page))
+		body := template.HTML(bodyParseMarkdown(pdata.Page, wikiResolver(h.i, h.c.SearchURL, viewer)))
 		toc := template.HTML(tocParseMarkdown(pdata.Page))
 		topics, keywords, authors := pdata.ListMeta()
 
 		// ##TODO## put this template right in the function call
 		// Then remove the Page Struct above
 		response := Page{
-			Title:    pdata.Title,
-			ToC:      toc,
-			Body:     body,
-			Keywords: keywords,
-			Topics:   topics,
-			Authors:  authors,
+			Title:       pdata.Title,
+			ToC:         toc,
+			Body:        body,
+			Keywords:    keywords,
+			Topics:      topics,
+			Authors:     authors,
+			Custom:      pdata.Custom,
+			Breadcrumbs: h.breadcrumbs(r.URL.Path, viewer),
+		}
+		if h.i != nil {
+			uriPath := path.Join(h.c.Prefix, r.URL.Path)
+			response.Backlinks, err = Backlinks(h.i, uriPath, pdata.Title, viewer)
+			if err != nil {
+				log.Printf("could not find the backlinks for [ %s ] - %v", uriPath, err)
+			}
+
+			find := func() ([]RelatedPage, error) {
+				return RelatedPages(h.i, uriPath, pdata, relatedCount(h.c), viewer)
+			}
+			if h.related != nil {
+				response.Related, err = h.related.get(h.i, relatedKey(uriPath, viewer), find)
+			} else {
+				response.Related, err = find()
+			}
+			if err != nil {
+				log.Printf("could not find the related pages for [ %s ] - %v", uriPath, err)
+			}
 		}
-		err = allTemplates.ExecuteTemplate(w, h.c.Template, response)
+		err = RenderTemplate(w, h.c.Template, response)
 		if err != nil {
 			http.Error(w, err.Error(), 500)
 		}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWantsJSON(t *testing.T) {
+	var tests = []struct {
+		request  string
+		accept   string
+		expected bool
+	}{
+		{"/search/?s=term", "", false},
+		{"/search/?s=term", "text/html,application/xhtml+xml", false},
+		{"/search/?s=term&format=json", "", true},
+		{"/search/?s=term&format=html", "", false},
+		{"/search/?s=term", "application/json", true},
+		{"/search/?s=term", "text/html, application/json; q=0.9", true},
+	}
+
+	for _, testSet := range tests {
+		r := httptest.NewRequest("GET", testSet.request, nil)
+		if testSet.accept != "" {
+			r.Header.Set("Accept", testSet.accept)
+		}
+		assert.Equal(t, testSet.expected, wantsJSON(r),
+			"[%q] with Accept [%q] got the wrong answer", testSet.request, testSet.accept)
+	}
+}
+
+func TestWriteResponseJSON(t *testing.T) {
+	data := SearchResponse{
+		TotalHits: 1,
+		Results: []SearchResponseResult{{
+			Title:     "Disk Space",
+			URIPath:   "/runbooks/disk.md",
+			Fragments: map[string][]template.HTML{"body": {"check <mark>disk</mark> usage"}},
+		}},
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/search/?s=disk&format=json", nil)
+	writeResponse(w, r, "search.html", data)
+
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var decoded SearchResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &decoded))
+	assert.Equal(t, data, decoded)
+}
+
+func TestPageValues(t *testing.T) {
+	var tests = []struct {
+		c        ServerSection
+		query    string
+		page     int
+		pageSize int
+	}{
+		{ServerSection{}, "", 1, defaultPageSize},
+		{ServerSection{}, "page=3&pageSize=20", 3, 20},
+		{ServerSection{}, "page=0&pageSize=-5", 1, defaultPageSize},
+		{ServerSection{}, "page=abc&pageSize=abc", 1, defaultPageSize},
+		{ServerSection{}, "pageSize=5000", 1, defaultMaxPageSize},
+		{ServerSection{PageSize: 25}, "", 1, 25},
+		{ServerSection{PageSize: 25, MaxPageSize: 50}, "page=2&pageSize=75", 2, 50},
+		{ServerSection{PageSize: 80, MaxPageSize: 50}, "", 1, 50},
+		{ServerSection{}, "page=999999999999&pageSize=20", maxResultWindow / 20, 20},
+		{ServerSection{MaxPageSize: 50000}, "page=3&pageSize=20000", 1, 20000},
+	}
+
+	for _, testSet := range tests {
+		form, err := url.ParseQuery(testSet.query)
+		assert.NoError(t, err)
+		page, pageSize := pageValues(testSet.c, form)
+		assert.Equal(t, testSet.page, page, "[%q] got the wrong page", testSet.query)
+		assert.Equal(t, testSet.pageSize, pageSize, "[%q] got the wrong page size", testSet.query)
+	}
+}
+
+func TestPageOffset(t *testing.T) {
+	var tests = []struct {
+		page     int
+		pageSize int
+		expected int
+	}{
+		{1, 10, 0},
+		{3, 10, 20},
+		{0, 10, 0},
+		{-4, 10, 0},
+		{2, -10, 0},
+		{maxResultWindow, 10, maxResultWindow - 10},
+		{int(^uint(0) >> 1), 100, maxResultWindow - 100},
+	}
+	for _, testSet := range tests {
+		offset := pageOffset(testSet.page, testSet.pageSize)
+		assert.Equal(t, testSet.expected, offset,
+			"page [%d] of [%d]", testSet.page, testSet.pageSize)
+	}
+}
+
+func TestSearchOptionsSort(t *testing.T) {
+	var tests = []struct {
+		configured string
+		query      string
+		expected   string
+	}{
+		{"", "", ""},
+		{"-modified", "", "-modified"},
+		{"-modified", "sort=title", "title"},
+		{"-modified", "sort=bogus", "-modified"},
+		{"", "sort=-path", "-path"},
+	}
+
+	for _, testSet := range tests {
+		form, err := url.ParseQuery(testSet.query)
+		assert.NoError(t, err)
+		opts, err := searchOptions(ServerSection{Sort: testSet.configured}, nil, form)
+		assert.NoError(t, err)
+		assert.Equal(t, testSet.expected, opts.Sort,
+			"configured [%q] with [%q] got the wrong sort", testSet.configured, testSet.query)
+	}
+}
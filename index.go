@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"log"
 	"os"
 	"path"
@@ -10,6 +12,7 @@ import (
 	"time"
 
 	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/analysis/analyzer/keyword"
 	blevemapping "github.com/blevesearch/bleve/mapping"
 
 	"github.com/JackKnifed/blackfriday"
@@ -21,18 +24,48 @@ type indexedPage struct {
 	Title    string    `json:"title"`
 	URIPath  string    `json:"path"`
 	Body     string    `json:"body"`
-	Topics   string    `json:"topic"`
-	Keywords string    `json:"keyword"`
-	Authors  string    `json:"author"`
+	Topics   []string  `json:"topic"`   // each normalized with normalizeTag
+	Keywords []string  `json:"keyword"` // each normalized with normalizeTag
+	Authors  []string  `json:"author"`  // each normalized with normalizeTag
 	Modified time.Time `json:"modified"`
+	Links    []string  `json:"links"` // the pages this page links to
+	// the titles this page links to with wiki links, as sortKey gives them
+	WikiLinks []string `json:"wikilinks"`
+	Access    []string `json:"access"` // the groups that may see this page
+	// the title and path kept whole and lower cased, to sort on
+	TitleSort string `json:"title_sort"`
+	PathSort  string `json:"path_sort"`
+	// the custom metadata in the index's Fields, keyed by field
+	Custom map[string][]string `json:"custom,omitempty"`
+}
+
+// the types a custom field can be indexed as
+const (
+	fieldText    = "text"
+	fieldKeyword = "keyword"
+	fieldDate    = "date"
+)
+
+// customField gives the name a piece of custom metadata is indexed under,
+//  within custom
+func customField(f FieldSection) string {
+	if f.Field != "" {
+		return f.Field
+	}
+	return strings.ToLower(f.Metadata)
 }
 
 type Index interface {
 	Close() error
+	Reopen(IndexSection) error
+	Stats() IndexStats
 	Wipe() error
+	Rebuild() error
+	ReindexURI(string) error
 	CrawlDir(string, string) error
 	WatchDir(string, string) error
 	Query(*bleve.SearchRequest) (*bleve.SearchResult, error)
+	Changes() uint64
 	// CreateResponseData(*bleve.SearchResult, int) (SearchResponse, error)
 	// ListField(string) ([]string, error)
 	// ListAllField(string, string, int, int) (SearchResponse, error)
@@ -41,6 +74,28 @@ type Index interface {
 	// FallbackSearchResponse(http.ResponseWriter, string)
 }
 
+// IndexStats tracks what the crawls and watchers of an index have done
+type IndexStats struct {
+	IndexPath        string    // location of the index
+	DocCount         uint64    // documents currently in the index
+	Batches          int       // number of batches applied
+	BatchedDocs      int       // documents updated or removed through batches
+	LastBatchSize    int       // documents in the most recent batch
+	MaxBatchSize     int       // documents in the largest batch
+	LastBatch        time.Time // when the most recent batch was applied
+	Skipped          int       // files skipped by the filter
+	Crawling         int       // crawls currently running
+	CrawledFiles     int       // files looked at by crawls
+	LastCrawl        time.Time // when the most recent crawl finished
+	Watchers         int       // watchers currently running
+	WatcherErrors    int       // errors reported by the watchers
+	LastWatcherError string    // the most recent error from a watcher
+	Rebuilding       bool      // a wipe and recrawl is running
+	RebuildStarted   time.Time // when the most recent rebuild started
+	RebuildFinished  time.Time // when the most recent rebuild finished
+	RebuildError     string    // the error that stopped the most recent rebuild
+}
+
 type indexObject struct {
 	index      bleve.Index
 	lock       sync.RWMutex
@@ -49,26 +104,254 @@ type indexObject struct {
 	log        *log.Logger
 	threads    sync.WaitGroup
 	closer     chan struct{}
+	debounce   time.Duration
+	filters    map[string]*fileFilter
+	stats      IndexStats
+	statsLock  sync.Mutex
+	changes    uint64 // counts every change to the documents, under lock
+	stale      bool   // documents were indexed with a different config
+}
+
+// mappingVersion is bumped whenever buildIndexMapping or the form of what is
+//  stored in it changes, so indexes built with an older mapping are rebuilt
+//  when they are opened
+const mappingVersion = 5
+
+// the internal keys the fingerprints of an index's config are stored under
+var (
+	mappingKey = []byte("goki.mapping")
+	contentKey = []byte("goki.content")
+)
+
+// mappingFingerprint covers everything the index mapping is built from. If
+//  it changes, the index has to be created again.
+func mappingFingerprint(c IndexSection) []byte {
+	fingerprint, _ := json.Marshal(struct {
+		Version   int
+		IndexType string
+		IndexName string
+		Fields    []FieldSection
+	}{mappingVersion, c.IndexType, c.IndexName, c.Fields})
+	return fingerprint
+}
+
+// contentFingerprint covers the config that changes what is stored for a
+//  page. If it changes, every page has to be indexed again.
+func contentFingerprint(c IndexSection) []byte {
+	fingerprint, _ := json.Marshal(struct {
+		Restricted  []string
+		Fields      []FieldSection
+		TopicGroups map[string][]string
+	}{c.Restricted, c.Fields, c.TopicGroups})
+	return fingerprint
 }
 
+// the default time the watcher waits after the last change before indexing
+const defaultWatchDelay = 10 * time.Second
+
 func OpenIndex(c IndexSection, l *log.Logger) (Index, error) {
-	i := &indexObject{config: c, log: l}
-	index, err := bleve.Open(path.Clean(i.config.IndexPath))
-	if err == nil {
-		i.index = index
-	} else if err == bleve.ErrorIndexPathDoesNotExist {
-		indexMapping := i.buildIndexMapping()
-		index, err = bleve.New(path.Clean(i.config.IndexPath), indexMapping)
+	if err := checkIndexSection(c); err != nil {
+		return nil, err
+	}
+
+	i := &indexObject{log: l}
+	if err := i.load(c); err != nil {
+		return nil, err
+	}
+	i.startThreads()
+	return i, nil
+}
+
+// checkIndexSection catches the mistakes in an index section that would stop
+//  it from being opened, without opening anything
+func checkIndexSection(c IndexSection) error {
+	if c.WatchDelay != "" {
+		if _, err := time.ParseDuration(c.WatchDelay); err != nil {
+			return &Error{Code: ErrBadDuration, value: c.WatchDelay, innerError: err}
+		}
+	}
+
+	for _, field := range c.Fields {
+		switch field.Type {
+		case "", fieldText, fieldKeyword, fieldDate:
+		default:
+			return &Error{Code: ErrBadFieldType, path: field.Metadata, value: field.Type}
+		}
+	}
+	return nil
+}
+
+// load sets up the index for a config, and opens the underlying index - or
+//  creates it, if there is not one at IndexPath yet. No crawls or watchers
+//  are started.
+func (i *indexObject) load(c IndexSection) error {
+	debounce := defaultWatchDelay
+	if c.WatchDelay != "" {
+		delay, err := time.ParseDuration(c.WatchDelay)
+		if err != nil {
+			return &Error{Code: ErrBadDuration, value: c.WatchDelay, innerError: err}
+		}
+		debounce = delay
+	}
+
+	filters := make(map[string]*fileFilter)
+	for filePrefix := range c.WatchDirs {
+		filter, err := newFileFilter(c, filePrefix)
 		if err != nil {
-			return nil, &Error{Code: ErrIndexCreate, value: c.IndexPath, innerError: err}
+			return err
+		}
+		filters[filter.root] = filter
+	}
+
+	i.config = c
+	i.debounce = debounce
+	i.filters = filters
+
+	index, err := bleve.Open(path.Clean(c.IndexPath))
+	switch {
+	case err == bleve.ErrorIndexPathDoesNotExist:
+		if index, err = i.createIndex(); err != nil {
+			return err
+		}
+	case err != nil:
+		return &Error{Code: ErrIndexError, path: c.IndexPath, innerError: err}
+	default:
+		stored, err := index.GetInternal(mappingKey)
+		if err != nil {
+			index.Close()
+			return &Error{Code: ErrIndexError, path: c.IndexPath, innerError: err}
+		}
+		if !bytes.Equal(stored, mappingFingerprint(c)) {
+			i.log.Printf("mapping for index [%s] changed, rebuilding", c.IndexPath)
+			if err := index.Close(); err != nil {
+				return &Error{Code: ErrIndexClose, innerError: err}
+			}
+			if index, err = i.createIndex(); err != nil {
+				return err
+			}
+		}
+	}
+
+	stored, err := index.GetInternal(contentKey)
+	i.stale = err != nil || !bytes.Equal(stored, contentFingerprint(c))
+	i.index = index
+	return nil
+}
+
+// createIndex creates an empty index at IndexPath with the mapping for the
+//  current config, replacing anything that was there
+func (i *indexObject) createIndex() (bleve.Index, error) {
+	if err := os.RemoveAll(i.config.IndexPath); err != nil {
+		return nil, &Error{Code: ErrIndexRemove, value: i.config.IndexPath, innerError: err}
+	}
+
+	index, err := bleve.New(path.Clean(i.config.IndexPath), i.buildIndexMapping())
+	if err != nil {
+		return nil, &Error{Code: ErrIndexCreate, value: i.config.IndexPath, innerError: err}
+	}
+	if err := index.SetInternal(mappingKey, mappingFingerprint(i.config)); err != nil {
+		index.Close()
+		return nil, &Error{Code: ErrIndexCreate, value: i.config.IndexPath, innerError: err}
+	}
+	return index, nil
+}
+
+// markCurrent records that every page was indexed with the current config
+func (i *indexObject) markCurrent() {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if err := i.index.SetInternal(contentKey, contentFingerprint(i.config)); err != nil {
+		i.log.Println(&Error{Code: ErrIndexError, value: i.config.IndexPath, innerError: err})
+		return
+	}
+	i.stale = false
+}
+
+// startThreads starts a watcher for each WatchDir, and a crawl through all
+//  of them. If the pages were indexed with a different config, the crawl
+//  indexes every page again, whether it changed or not.
+func (i *indexObject) startThreads() {
+	// the closing channel has to exist before anything can listen on it
+	i.lock.Lock()
+	i.closer = make(chan struct{})
+	i.lock.Unlock()
+
+	prefixes := i.watchPrefixes()
+	for filePrefix, uriPrefix := range prefixes {
+		i.threads.Add(1)
+		go func(filePrefix, uriPrefix string) {
+			defer i.threads.Done()
+			if err := i.WatchDir(filePrefix, uriPrefix); err != nil {
+				i.log.Println(err)
+			}
+		}(filePrefix, uriPrefix)
+		i.log.Printf("watching and walking [%s]", filePrefix)
+	}
+
+	force := i.stale
+	if force {
+		i.log.Printf("config for index [%s] changed, indexing every page again",
+			i.config.IndexPath)
+	}
+	i.threads.Add(1)
+	go func() {
+		defer i.threads.Done()
+		for filePrefix, uriPrefix := range prefixes {
+			if err := i.crawlDir(filePrefix, uriPrefix, force); err != nil {
+				i.log.Println(err)
+				return
+			}
+		}
+		if force {
+			i.markCurrent()
 		}
+	}()
+}
+
+// stopThreads stops the watchers and any running crawl, and waits for them.
+//  The closer is closed under the lock, so Rebuild can not start a thread
+//  that is missed by the wait.
+func (i *indexObject) stopThreads() {
+	i.lock.Lock()
+	close(i.closer)
+	i.lock.Unlock()
+	i.threads.Wait()
+}
 
-		i.index = index
+// Reopen switches the index over to a changed config while it stays in use.
+//  The watchers and crawls are stopped, and the underlying index is closed
+//  and opened again with queries held off, so they never see it closed. If
+//  the new config fails to open, the old one is opened again.
+func (i *indexObject) Reopen(c IndexSection) error {
+	if err := checkIndexSection(c); err != nil {
+		return err
 	}
+	i.stopThreads()
 
-	// start watchers
+	i.lock.Lock()
+	old := i.config
+	if err := i.index.Close(); err != nil {
+		i.log.Println(&Error{Code: ErrIndexClose, innerError: err})
+	}
+	err := i.load(c)
+	if err != nil {
+		if oldErr := i.load(old); oldErr != nil {
+			i.log.Println(oldErr)
+		}
+	}
+	i.changes++
+	i.lock.Unlock()
+
+	i.startThreads()
+	return err
+}
+
+// watchPrefixes gives the WatchDirs, with both the file and URI prefixes
+//  cleaned up and ending in a /
+func (i *indexObject) watchPrefixes() map[string]string {
+	prefixes := make(map[string]string)
 	for filePrefix, uriPrefix := range i.config.WatchDirs {
-		filePrefix := filepath.Clean(filePrefix)
+		filePrefix = filepath.Clean(filePrefix)
 		uriPrefix = path.Clean(uriPrefix)
 		if !strings.HasSuffix(filePrefix, "/") {
 			filePrefix += "/"
@@ -76,18 +359,9 @@ func OpenIndex(c IndexSection, l *log.Logger) (Index, error) {
 		if !strings.HasSuffix(uriPrefix, "/") {
 			uriPrefix += "/"
 		}
-
-		go i.WatchDir(filePrefix, uriPrefix)
-		go i.CrawlDir(filePrefix, uriPrefix)
-		i.log.Printf("watching and walking [%s]", filePrefix)
+		prefixes[filePrefix] = uriPrefix
 	}
-
-	// prime the closing channel
-	i.closer = make(chan struct{}, 1)
-	i.closer <- struct{}{}
-	<-i.closer
-
-	return i, nil
+	return prefixes
 }
 
 func (i *indexObject) buildIndexMapping() blevemapping.IndexMapping {
@@ -99,30 +373,71 @@ func (i *indexObject) buildIndexMapping() blevemapping.IndexMapping {
 	// create a date field type
 	dateTimeMapping := bleve.NewDateTimeFieldMapping()
 
+	// links and groups are matched whole, so they are not split into words
+	linkFieldMapping := bleve.NewTextFieldMapping()
+	linkFieldMapping.Analyzer = keyword.Name
+	linkFieldMapping.IncludeInAll = false
+
+	// topics, keywords, and authors are kept whole too, so a tag of several
+	//  words is searched, filtered, and listed as one
+	tagFieldMapping := bleve.NewTextFieldMapping()
+	tagFieldMapping.Analyzer = keyword.Name
+
+	// the copies of the title and path sorted on are single terms, so they
+	//  sort in alphabetical order rather than by their words
+	sortFieldMapping := bleve.NewTextFieldMapping()
+	sortFieldMapping.Analyzer = keyword.Name
+	sortFieldMapping.Store = false
+	sortFieldMapping.IncludeInAll = false
+
 	// map out the wiki page
 	wikiMapping := bleve.NewDocumentMapping()
 	wikiMapping.AddFieldMappingsAt("title", enTextFieldMapping)
 	wikiMapping.AddFieldMappingsAt("path", enTextFieldMapping)
 	wikiMapping.AddFieldMappingsAt("body", enTextFieldMapping)
-	wikiMapping.AddFieldMappingsAt("topic", enTextFieldMapping)
-	wikiMapping.AddFieldMappingsAt("keyword", enTextFieldMapping)
-	wikiMapping.AddFieldMappingsAt("author", enTextFieldMapping)
+	wikiMapping.AddFieldMappingsAt("topic", tagFieldMapping)
+	wikiMapping.AddFieldMappingsAt("keyword", tagFieldMapping)
+	wikiMapping.AddFieldMappingsAt("author", tagFieldMapping)
 	wikiMapping.AddFieldMappingsAt("modified", dateTimeMapping)
+	wikiMapping.AddFieldMappingsAt("links", linkFieldMapping)
+	wikiMapping.AddFieldMappingsAt("wikilinks", linkFieldMapping)
+	wikiMapping.AddFieldMappingsAt("access", linkFieldMapping)
+	wikiMapping.AddFieldMappingsAt("title_sort", sortFieldMapping)
+	wikiMapping.AddFieldMappingsAt("path_sort", sortFieldMapping)
+
+	// custom metadata is only indexed if it is one of the Fields
+	keywordFieldMapping := bleve.NewTextFieldMapping()
+	keywordFieldMapping.Analyzer = keyword.Name
+	customMapping := bleve.NewDocumentMapping()
+	for _, field := range i.config.Fields {
+		switch field.Type {
+		case fieldKeyword:
+			customMapping.AddFieldMappingsAt(customField(field), keywordFieldMapping)
+		case fieldDate:
+			customMapping.AddFieldMappingsAt(customField(field), dateTimeMapping)
+		default:
+			customMapping.AddFieldMappingsAt(customField(field), enTextFieldMapping)
+		}
+	}
+	wikiMapping.AddSubDocumentMapping("custom", customMapping)
 
 	// add the wiki page mapping to a new index
 	indexMapping := bleve.NewIndexMapping()
 	indexMapping.AddDocumentMapping(i.config.IndexName, wikiMapping)
+	// pages do not say their type, so they all get the wiki page mapping
+	indexMapping.DefaultType = i.config.IndexName
 	indexMapping.DefaultAnalyzer = i.config.IndexType
 
 	return indexMapping
 }
 
+// Close stops the watchers and any running crawl, waits for them to finish,
+//  then closes the underlying index.
 func (i *indexObject) Close() error {
-	// dump something into the channel incase it's currently nil
-	i.closer <- struct{}{}
-	close(i.closer)
+	i.stopThreads()
 
-	i.threads.Wait()
+	i.lock.Lock()
+	defer i.lock.Unlock()
 
 	if err := i.index.Close(); err != nil {
 		return &Error{Code: ErrIndexClose, innerError: err}
@@ -130,109 +445,506 @@ func (i *indexObject) Close() error {
 	return nil
 }
 
+// Wipe removes the index from disk, and replaces it with an empty one
 func (i *indexObject) Wipe() error {
 	i.lock.Lock()
+	defer i.lock.Unlock()
+
 	if err := i.index.Close(); err != nil {
-		i.lock.Unlock()
 		return &Error{Code: ErrIndexClose, innerError: err}
 	}
 
-	if err := os.RemoveAll(i.config.IndexPath); err != nil {
-		return &Error{Code: ErrIndexRemove, value: i.config.IndexPath, innerError: err}
+	index, err := i.createIndex()
+	if err != nil {
+		return err
 	}
 
-	// TODO not sure if needed
-	if err := os.Mkdir(i.config.IndexPath, 644); err != nil {
-		return &Error{Code: ErrIndexCreate, value: i.config, innerError: err}
+	i.index = index
+	i.changes++
+	return nil
+}
+
+// Rebuild wipes the index and crawls every WatchDir again, in the
+//  background. Progress shows up in Stats.
+func (i *indexObject) Rebuild() error {
+	// checked and added under the same lock stopThreads closes the closer
+	//  with, so a closing index either refuses the rebuild or waits for it
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	select {
+	case <-i.closer:
+		return &Error{Code: ErrIndexClosing, value: i.config.IndexPath}
+	default:
 	}
-	// remove index
 
-	indexMapping := i.buildIndexMapping()
-	index, err := bleve.New(path.Clean(i.config.IndexPath), indexMapping)
-	if err != nil {
-		close(i.closer)
-		return &Error{Code: ErrIndexCreate, value: i.config, innerError: err}
+	i.statsLock.Lock()
+	if i.stats.Rebuilding {
+		i.statsLock.Unlock()
+		return &Error{Code: ErrRebuildRunning, value: i.config.IndexPath}
 	}
+	i.stats.Rebuilding = true
+	i.stats.RebuildStarted = time.Now()
+	i.stats.RebuildError = ""
+	i.statsLock.Unlock()
 
-	i.index = index
-	i.lock.Unlock()
+	i.threads.Add(1)
+	go func() {
+		defer i.threads.Done()
+		err := i.rebuild()
+		if err != nil {
+			i.log.Println(err)
+		}
+
+		i.statsLock.Lock()
+		defer i.statsLock.Unlock()
+		i.stats.Rebuilding = false
+		i.stats.RebuildFinished = time.Now()
+		if err != nil {
+			i.stats.RebuildError = err.Error()
+		}
+	}()
 	return nil
 }
 
+func (i *indexObject) rebuild() error {
+	i.log.Printf("rebuilding index [%s]", i.config.IndexPath)
+	if err := i.Wipe(); err != nil {
+		return err
+	}
+	for filePrefix, uriPrefix := range i.watchPrefixes() {
+		if err := i.CrawlDir(filePrefix, uriPrefix); err != nil {
+			return err
+		}
+	}
+	i.markCurrent()
+	i.log.Printf("rebuilt index [%s]", i.config.IndexPath)
+	return nil
+}
+
+// ReindexURI indexes the file for a single URI again, or removes it from the
+//  index if the file is gone.
+func (i *indexObject) ReindexURI(uriPath string) error {
+	filePath, watchPath, err := i.fileForURI(uriPath)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(filePath)
+	switch {
+	case os.IsNotExist(err):
+		return i.DeleteURI(uriPath)
+	case err != nil:
+		return &Error{Code: ErrFileRead, value: filePath, innerError: err}
+	case info.IsDir() || i.filterFor(watchPath).skip(filePath, info):
+		return &Error{Code: ErrNoFileForURI, value: uriPath}
+	}
+
+	err = i.UpdateURI(filePath, uriPath)
+	if e, ok := err.(*Error); ok && e.Code == ErrPageRestricted {
+		return i.DeleteURI(uriPath)
+	}
+	return err
+}
+
+// fileForURI finds the file a URI was indexed from, using the most specific
+//  WatchDir it falls under. The WatchDir is returned too.
+func (i *indexObject) fileForURI(uriPath string) (string, string, error) {
+	var bestFile, bestURI string
+	for filePrefix, uriPrefix := range i.watchPrefixes() {
+		if strings.HasPrefix(uriPath, uriPrefix) && len(uriPrefix) > len(bestURI) {
+			bestFile, bestURI = filePrefix, uriPrefix
+		}
+	}
+	if bestURI == "" {
+		return "", "", &Error{Code: ErrNoFileForURI, value: uriPath}
+	}
+	filePath := filepath.Join(bestFile, filepath.FromSlash(strings.TrimPrefix(uriPath, bestURI)))
+	return filePath, bestFile, nil
+}
+
+// WatchDir watches watchPath and every directory underneath it for changes,
+//  and updates the index once the changes settle. Directories created later
+//  are watched as they show up.
 func (i *indexObject) WatchDir(watchPath, uriPrefix string) error {
 	i.log.Printf("watching '%s' for changes...", watchPath)
+	i.updateStats(func(s *IndexStats) { s.Watchers++ })
+	defer i.updateStats(func(s *IndexStats) { s.Watchers-- })
 
-	i.threads.Add(1)
-	defer i.threads.Done()
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return &Error{Code: ErrWatcherCreate, innerError: err}
 	}
 	defer watcher.Close()
 
-	err = watcher.Add(strings.TrimSuffix(watchPath, "/"))
+	filter := i.filterFor(watchPath)
+	watchedDirs := make(map[string]bool)
+	err = i.watchRecursive(watcher, strings.TrimSuffix(watchPath, "/"), watchedDirs)
 	if err != nil {
-		return &Error{Code: ErrWatcherAdd, value: watchPath, innerError: err}
+		return err
 	}
 
-	idleTimer := time.NewTimer(10 * time.Second)
-	var queuedEvents []fsnotify.Event
-	var more bool
+	// queued changes are keyed by path, so repeated events only count once
+	idleTimer := time.NewTimer(i.debounce)
+	idleTimer.Stop()
+	queued := make(map[string]bool)
 
-	for more {
+	for {
 		select {
-		case _, more = <-i.closer:
-		case event := <-watcher.Events:
-			queuedEvents = append(queuedEvents, event)
-			idleTimer.Reset(10 * time.Second)
-		case err := <-watcher.Errors:
-			i.log.Fatal(err)
-		case <-idleTimer.C:
-			for _, event := range queuedEvents {
-				if filepath.Ext(event.Name) == i.config.WatchExtension {
-					switch event.Op {
-					case fsnotify.Remove, fsnotify.Rename:
-						// delete the filePath
-						i.DeleteURI(uriPrefix + event.Name)
-					case fsnotify.Create, fsnotify.Write:
-						// update the filePath
-						i.UpdateURI(watchPath+event.Name, uriPrefix+event.Name)
-					default:
-						// no changes, so repeat the cycle
-					}
+		case <-i.closer:
+			return nil
+		case event, more := <-watcher.Events:
+			if !more {
+				return nil
+			}
+			if filepath.Clean(event.Name) == filepath.Join(filter.root, ignoreFileName) {
+				if err := filter.loadIgnores(); err != nil {
+					i.log.Println(err)
 				}
 			}
-			queuedEvents = make([]fsnotify.Event, 0)
-			idleTimer.Reset(10 * time.Second)
+			queued[filepath.Clean(event.Name)] = true
+			i.trackDirs(watcher, event, watchedDirs, watchPath, uriPrefix)
+			idleTimer.Reset(i.debounce)
+		case err, more := <-watcher.Errors:
+			if !more {
+				return nil
+			}
+			err = &Error{Code: ErrWatcherError, innerError: err}
+			i.log.Println(err)
+			i.updateStats(func(s *IndexStats) {
+				s.WatcherErrors++
+				s.LastWatcherError = err.Error()
+			})
+		case <-idleTimer.C:
+			if err := i.applyChanges(queued, watchPath, uriPrefix); err != nil {
+				i.log.Println(err)
+			}
+			queued = make(map[string]bool)
+		}
+	}
+}
+
+// watchRecursive adds dir and every directory underneath it to the watcher,
+//  leaving out any directory the filter skips
+func (i *indexObject) watchRecursive(watcher *fsnotify.Watcher, dir string,
+	watchedDirs map[string]bool) error {
+	filter := i.filterFor(dir)
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		if filter.skip(path, info) {
+			return filepath.SkipDir
+		}
+		if err := watcher.Add(path); err != nil {
+			return &Error{Code: ErrWatcherAdd, value: path, innerError: err}
+		}
+		watchedDirs[filepath.Clean(path)] = true
+		return nil
+	})
+}
+
+// trackDirs keeps the watcher in sync with the directory tree - new
+//  directories are watched and crawled, and removed or moved directories are
+//  dropped along with everything indexed under them.
+func (i *indexObject) trackDirs(watcher *fsnotify.Watcher, event fsnotify.Event,
+	watchedDirs map[string]bool, watchPath, uriPrefix string) {
+	name := filepath.Clean(event.Name)
+	dirURI := i.getURI(name, watchPath, uriPrefix) + "/"
+
+	if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 && watchedDirs[name] {
+		for dir := range watchedDirs {
+			if dir == name || strings.HasPrefix(dir, name+string(filepath.Separator)) {
+				// the watch may already be gone, so the error does not matter
+				watcher.Remove(dir)
+				delete(watchedDirs, dir)
+			}
+		}
+		if err := i.DeleteURIPrefix(dirURI); err != nil {
+			i.log.Println(err)
+		}
+	}
+
+	if event.Op&fsnotify.Create != 0 {
+		info, err := os.Stat(name)
+		if err != nil || !info.IsDir() || i.filterFor(name).skip(name, info) {
+			return
+		}
+		if err := i.watchRecursive(watcher, name, watchedDirs); err != nil {
+			i.log.Println(err)
+		}
+		// anything already in the new directory was never seen by the watcher
+		if err := i.CrawlDir(name+"/", dirURI); err != nil {
+			i.log.Println(err)
+		}
+	}
+}
+
+// applyChanges brings the index in line with what is on disk for every
+//  queued path, as one batch. Whatever happened to a file, it is reindexed if
+//  it exists, and removed if it does not - so a move is a delete of the old
+//  path and a create of the new one. The batch is built and applied under
+//  the lock, so it always goes to the index it was made for.
+func (i *indexObject) applyChanges(queued map[string]bool,
+	watchPath, uriPrefix string) error {
+	filter := i.filterFor(watchPath)
+	updates := make(map[string]interface{})
+	var removes []string
+	var skipped int
+
+	for filePath := range queued {
+		uriPath := i.getURI(filePath, watchPath, uriPrefix)
+
+		info, err := os.Stat(filePath)
+		switch {
+		case os.IsNotExist(err):
+			removes = append(removes, uriPath)
+			continue
+		case err != nil:
+			i.log.Println(&Error{Code: ErrFileRead, value: filePath, innerError: err})
+			continue
+		case info.IsDir():
+			// the files within a directory have their own events
+			continue
+		case filter.skip(filePath, info):
+			skipped++
+			continue
+		}
+
+		page, err := i.generateWikiFromFile(filePath, uriPath)
+		if e, ok := err.(*Error); ok && e.Code == ErrPageRestricted {
+			// the page might have been indexed before it was restricted
+			removes = append(removes, uriPath)
+			continue
+		} else if err != nil {
+			i.log.Println(err)
+			continue
+		}
+		updates[uriPath] = page
+	}
+
+	i.recordSkipped(skipped)
+	if len(updates)+len(removes) == 0 {
+		return nil
+	}
+
+	i.lock.Lock()
+	batch := i.index.NewBatch()
+	for _, uriPath := range removes {
+		batch.Delete(uriPath)
+	}
+	for uriPath, page := range updates {
+		if err := batch.Index(uriPath, page); err != nil {
+			i.log.Println(&Error{Code: ErrIndexError, value: uriPath, innerError: err})
+			delete(updates, uriPath)
 		}
 	}
+	err := i.index.Batch(batch)
+	i.changes++
+	i.lock.Unlock()
+	if err != nil {
+		return &Error{Code: ErrIndexError, value: watchPath, innerError: err}
+	}
+
+	i.recordBatch(len(updates) + len(removes))
+	i.log.Printf("applied batch to [%s] - %d updated, %d removed",
+		i.config.IndexPath, len(updates), len(removes))
 	return nil
 }
 
-func (i *indexObject) indexFileFunc(rootPath, uriPrefix string) filepath.WalkFunc {
+func (i *indexObject) recordBatch(size int) {
+	i.statsLock.Lock()
+	defer i.statsLock.Unlock()
+	i.stats.Batches++
+	i.stats.BatchedDocs += size
+	i.stats.LastBatchSize = size
+	if size > i.stats.MaxBatchSize {
+		i.stats.MaxBatchSize = size
+	}
+	i.stats.LastBatch = time.Now()
+}
+
+// Stats gives back a copy of the stats for the index
+func (i *indexObject) Stats() IndexStats {
+	// Reopen and Wipe change the config and index under the lock
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	i.statsLock.Lock()
+	stats := i.stats
+	i.statsLock.Unlock()
+
+	stats.IndexPath = i.config.IndexPath
+	if count, err := i.index.DocCount(); err == nil {
+		stats.DocCount = count
+	}
+	return stats
+}
+
+// updateStats safely makes a change to the stats
+func (i *indexObject) updateStats(change func(*IndexStats)) {
+	i.statsLock.Lock()
+	defer i.statsLock.Unlock()
+	change(&i.stats)
+}
+
+func (i *indexObject) recordSkipped(count int) {
+	i.statsLock.Lock()
+	defer i.statsLock.Unlock()
+	i.stats.Skipped += count
+}
+
+// filterFor gives the filter of the WatchDir a path is in
+func (i *indexObject) filterFor(filePath string) *fileFilter {
+	filePath = filepath.Clean(filePath)
+	var found *fileFilter
+	for root, filter := range i.filters {
+		if (filePath == root || strings.HasPrefix(filePath, root+string(filepath.Separator))) &&
+			(found == nil || len(root) > len(found.root)) {
+			found = filter
+		}
+	}
+	if found != nil {
+		return found
+	}
+
+	// not within a WatchDir, so filter it on its own
+	found, err := newFileFilter(i.config, filePath)
+	if err != nil {
+		i.log.Println(err)
+		found = &fileFilter{root: filePath}
+	}
+	return found
+}
+
+// crawlState tracks a single crawl of a directory
+type crawlState struct {
+	indexed   map[string]time.Time // URI -> modified time stored in the index
+	seen      map[string]bool      // URIs found on disk
+	filter    *fileFilter
+	force     bool // index every file, even if it did not change
+	updated   int
+	unchanged int
+	skipped   int
+}
+
+func (i *indexObject) indexFileFunc(rootPath, uriPrefix string,
+	state *crawlState) filepath.WalkFunc {
 	return func(path string, info os.FileInfo, err error) error {
-		if info != nil && !info.IsDir() {
-			err := i.UpdateURI(path, i.getURI(path, rootPath, uriPrefix))
-			if err != nil {
-				i.log.Println(err)
+		// stop walking if the index is being closed
+		select {
+		case <-i.closer:
+			return &Error{Code: ErrIndexClosing, value: rootPath}
+		default:
+		}
+
+		if info == nil {
+			return nil
+		}
+		if state.filter.skip(path, info) {
+			if info.IsDir() {
+				return filepath.SkipDir
 			}
+			state.skipped++
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		uriPath := i.getURI(path, rootPath, uriPrefix)
+		state.seen[uriPath] = true
+		i.updateStats(func(s *IndexStats) { s.CrawledFiles++ })
+
+		// the index only stores the modified time to the second
+		if stored, ok := state.indexed[uriPath]; ok && !state.force &&
+			stored.Equal(info.ModTime().Truncate(time.Second)) {
+			state.unchanged++
+			return nil
+		}
+
+		err = i.UpdateURI(path, uriPath)
+		if e, ok := err.(*Error); ok && e.Code == ErrPageRestricted {
+			// the page might have been indexed before it was restricted
+			err = i.DeleteURI(uriPath)
+		} else if err == nil {
+			state.updated++
+		}
+		if err != nil {
+			i.log.Println(err)
 		}
 		return nil
 	}
 }
 
+// CrawlDir walks a directory, and indexes every file that changed since it
+//  was last indexed. Anything indexed under uriPrefix that is no longer on
+//  disk is removed.
 func (i *indexObject) CrawlDir(path, uriPrefix string) error {
-	err := filepath.Walk(path, i.indexFileFunc(path, uriPrefix))
+	return i.crawlDir(path, uriPrefix, false)
+}
+
+// crawlDir is CrawlDir, optionally indexing every file whether it changed or
+//  not
+func (i *indexObject) crawlDir(path, uriPrefix string, force bool) error {
+	i.updateStats(func(s *IndexStats) { s.Crawling++ })
+	defer i.updateStats(func(s *IndexStats) { s.Crawling-- })
+
+	indexed, err := i.indexedModTimes()
 	if err != nil {
 		return err
 	}
+
+	state := &crawlState{
+		indexed: indexed,
+		seen:    make(map[string]bool),
+		filter:  i.filterFor(path),
+		force:   force,
+	}
+	err = filepath.Walk(path, i.indexFileFunc(path, uriPrefix, state))
+	if err != nil {
+		return err
+	}
+
+	var removed int
+	for uriPath := range indexed {
+		if state.seen[uriPath] || !i.ownsURI(uriPath, uriPrefix) {
+			continue
+		}
+		if err := i.DeleteURI(uriPath); err != nil {
+			i.log.Println(err)
+			continue
+		}
+		removed++
+	}
+
+	i.recordSkipped(state.skipped)
+	i.updateStats(func(s *IndexStats) { s.LastCrawl = time.Now() })
+	i.log.Printf("crawled [%s] - %d updated, %d unchanged, %d skipped, %d removed",
+		path, state.updated, state.unchanged, state.skipped, removed)
 	return nil
 }
 
+// ownsURI checks if a URI falls under uriPrefix, and not under a more
+//  specific prefix belonging to a different WatchDir.
+func (i *indexObject) ownsURI(uriPath, uriPrefix string) bool {
+	if !strings.HasPrefix(uriPath, uriPrefix) {
+		return false
+	}
+	for _, otherPrefix := range i.watchPrefixes() {
+		if len(otherPrefix) > len(uriPrefix) &&
+			strings.HasPrefix(otherPrefix, uriPrefix) &&
+			strings.HasPrefix(uriPath, otherPrefix) {
+			return false
+		}
+	}
+	return true
+}
+
 func (i *indexObject) DeleteURI(uriPath string) error {
 	i.lock.Lock()
 	defer i.lock.Unlock()
 	i.log.Printf("removing %s", uriPath)
+	i.changes++
 	err := i.index.Delete(uriPath)
 	if err != nil {
 		return &Error{Code: ErrIndexError, value: uriPath, innerError: err}
@@ -240,6 +952,51 @@ func (i *indexObject) DeleteURI(uriPath string) error {
 	return nil
 }
 
+// DeleteURIPrefix removes every document with a URI starting with prefix
+func (i *indexObject) DeleteURIPrefix(prefix string) error {
+	indexed, err := i.indexedModTimes()
+	if err != nil {
+		return err
+	}
+	for uri := range indexed {
+		if strings.HasPrefix(uri, prefix) {
+			if err := i.DeleteURI(uri); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// indexedModTimes pages through every document in the index, and returns
+//  the modified time stored for each URI
+func (i *indexObject) indexedModTimes() (map[string]time.Time, error) {
+	const pageSize = 500
+	indexed := make(map[string]time.Time)
+	for from := 0; ; from += pageSize {
+		request := bleve.NewSearchRequestOptions(bleve.NewMatchAllQuery(),
+			pageSize, from, false)
+		request.Fields = []string{"modified", "access"}
+		result, err := i.Query(request)
+		if err != nil {
+			return nil, err
+		}
+		for _, hit := range result.Hits {
+			// a missing or bad time is left as zero, so it gets reindexed
+			stored, _ := hit.Fields["modified"].(string)
+			modified, _ := time.Parse(time.RFC3339, stored)
+			// as is a page indexed before its groups were
+			if _, ok := hit.Fields["access"]; !ok {
+				modified = time.Time{}
+			}
+			indexed[hit.ID] = modified
+		}
+		if len(result.Hits) < pageSize {
+			return indexed, nil
+		}
+	}
+}
+
 func (i *indexObject) UpdateURI(filePath, uriPath string) error {
 	page, err := i.generateWikiFromFile(filePath, uriPath)
 	if err != nil {
@@ -249,6 +1006,7 @@ func (i *indexObject) UpdateURI(filePath, uriPath string) error {
 	i.lock.Lock()
 	defer i.lock.Unlock()
 	i.log.Printf("updated: [%s] as [%s] indexed at [%s]", filePath, page.URIPath, uriPath)
+	i.changes++
 	err = i.index.Index(uriPath, page)
 	if err != nil {
 		return &Error{Code: ErrIndexError, value: uriPath, innerError: err}
@@ -256,6 +1014,14 @@ func (i *indexObject) UpdateURI(filePath, uriPath string) error {
 	return nil
 }
 
+// Changes counts the changes made to the documents in the index. Anything
+//  worked out from the index is out of date once this goes up.
+func (i *indexObject) Changes() uint64 {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	return i.changes
+}
+
 func (i *indexObject) Query(request *bleve.SearchRequest) (*bleve.SearchResult, error) {
 	i.lock.RLock()
 	defer i.lock.RUnlock()
@@ -284,19 +1050,48 @@ func (i *indexObject) generateWikiFromFile(filePath, uriPath string) (*indexedPa
 	}
 
 	topics, keywords, authors := pdata.ListMeta()
+	links, titles := pageLinks(pdata.Page, uriPath)
 	rv := indexedPage{
-		Title:    pdata.Title,
-		Body:     i.cleanupMarkdown(pdata.Page),
-		URIPath:  strings.TrimSuffix(uriPath, ".md"),
-		Topics:   strings.Join(topics, " "),
-		Keywords: strings.Join(keywords, " "),
-		Authors:  strings.Join(authors, " "),
-		Modified: pdata.FileStats.ModTime(),
+		Title:     pdata.Title,
+		TitleSort: sortKey(pdata.Title),
+		PathSort:  sortKey(strings.TrimSuffix(uriPath, ".md")),
+		Body:      i.cleanupMarkdown(pdata.Page),
+		URIPath:   strings.TrimSuffix(uriPath, ".md"),
+		Topics:    topics,
+		Keywords:  keywords,
+		Authors:   authors,
+		Modified:  pdata.FileStats.ModTime(),
+		Links:     links,
+		WikiLinks: titles,
+		Custom:    i.customFields(pdata.Custom),
+		Access:    accessGroups(pdata, i.config.TopicGroups),
 	}
 
 	return &rv, nil
 }
 
+// sortKey gives the value a title or path is sorted by
+func sortKey(s string) string {
+	return strings.ToLower(strings.TrimSpace(s))
+}
+
+// customFields picks out the custom metadata of a page that is in the
+//  index's Fields, keyed by the field each is indexed under
+func (i *indexObject) customFields(custom map[string][]string) map[string][]string {
+	var fields map[string][]string
+	for _, field := range i.config.Fields {
+		values := custom[strings.ToLower(field.Metadata)]
+		if len(values) == 0 {
+			continue
+		}
+		if fields == nil {
+			fields = make(map[string][]string)
+		}
+		fields[customField(field)] = append(fields[customField(field)], values...)
+	}
+	return fields
+}
+
 func (i *indexObject) cleanupMarkdown(input []byte) string {
 	extensions := 0 | blackfriday.EXTENSION_ALERT_BOXES
 	renderer := blackfridaytext.TextRenderer()
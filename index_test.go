@@ -0,0 +1,561 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	blevequery "github.com/blevesearch/bleve/search/query"
+	"github.com/stretchr/testify/assert"
+)
+
+// waitFor polls until check passes, failing the test if it takes too long
+func waitFor(t *testing.T, what string, check func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !check() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWatchDirBatches(t *testing.T) {
+	root, err := ioutil.TempDir("", "watch.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	pages := filepath.Join(root, "pages")
+	writeTestTree(t, pages, map[string]string{"kept.md": "Title: Kept\n\nalready here\n"})
+
+	index, err := OpenIndex(IndexSection{
+		WatchDirs:      map[string]string{pages + "/": "/"},
+		WatchExtension: ".md",
+		WatchDelay:     "200ms",
+		IndexPath:      filepath.Join(root, "index"),
+		IndexType:      "en",
+		IndexName:      "wiki",
+	}, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	waitFor(t, "the first crawl", func() bool {
+		s := index.Stats()
+		return s.Watchers == 1 && s.DocCount == 1 && s.Crawling == 0
+	})
+	// give the watcher time to add the directory
+	time.Sleep(50 * time.Millisecond)
+
+	// all within the delay, so they should land as one batch
+	gone := filepath.Join(pages, "gone.md")
+	added := filepath.Join(pages, "added.md")
+	assert.NoError(t, ioutil.WriteFile(gone, []byte("Title: Gone\n\nshort lived\n"), 0644))
+	assert.NoError(t, ioutil.WriteFile(added, []byte("Title: First\n\ndraft\n"), 0644))
+	assert.NoError(t, os.Remove(gone))
+	assert.NoError(t, ioutil.WriteFile(added, []byte("Title: Added\n\nfinal\n"), 0644))
+
+	waitFor(t, "the batch", func() bool { return index.Stats().Batches > 0 })
+	// a second batch would follow a delay after the first
+	time.Sleep(400 * time.Millisecond)
+
+	stats := index.Stats()
+	assert.Equal(t, 1, stats.Batches, "the changes should be applied as one batch")
+	assert.Equal(t, uint64(2), stats.DocCount)
+
+	request := bleve.NewSearchRequest(bleve.NewDocIDQuery([]string{"/added.md", "/gone.md"}))
+	request.Fields = []string{"title"}
+	results, err := index.Query(request)
+	assert.NoError(t, err)
+	if assert.Len(t, results.Hits, 1, "only the file that is left should be indexed") {
+		assert.Equal(t, "/added.md", results.Hits[0].ID)
+		assert.Equal(t, "Added", results.Hits[0].Fields["title"])
+	}
+}
+
+func TestReopenChangedConfig(t *testing.T) {
+	root, err := ioutil.TempDir("", "reopen.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	pages := filepath.Join(root, "pages")
+	writeTestTree(t, pages, map[string]string{
+		"open.md":     "---\ntitle: Open\nowner: ops\n---\nfor everyone\n",
+		"internal.md": "Title: Internal\nTopic: internal\n\nnot for everyone\n",
+	})
+
+	section := IndexSection{
+		WatchDirs:      map[string]string{pages + "/": "/"},
+		WatchExtension: ".md",
+		IndexPath:      filepath.Join(root, "index"),
+		IndexType:      "en",
+		IndexName:      "wiki",
+	}
+	logs := log.New(ioutil.Discard, "", 0)
+	openIndex := func(c IndexSection) Index {
+		index, err := OpenIndex(c, logs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "the first crawl", func() bool {
+			s := index.Stats()
+			return s.LastCrawl.After(time.Time{}) && s.Crawling == 0
+		})
+		return index
+	}
+	count := func(index Index, q blevequery.Query) int {
+		results, err := index.Query(bleve.NewSearchRequest(q))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return int(results.Total)
+	}
+
+	index := openIndex(section)
+	assert.Equal(t, uint64(2), index.Stats().DocCount)
+	assert.NoError(t, index.Close())
+
+	// none of the files changed, but the restricted page has to go
+	restricted := section
+	restricted.Restricted = []string{"internal"}
+	index = openIndex(restricted)
+	assert.Equal(t, uint64(1), index.Stats().DocCount,
+		"a change to Restricted should index every page again")
+	assert.NoError(t, index.Close())
+
+	// a new field changes the mapping, so the index is built again
+	fields := restricted
+	fields.Fields = []FieldSection{{Metadata: "Owner", Type: fieldKeyword}}
+	index = openIndex(fields)
+	assert.Equal(t, uint64(1), index.Stats().DocCount)
+	owner := bleve.NewTermQuery("ops")
+	owner.SetField("custom.owner")
+	assert.Equal(t, 1, count(index, owner), "existing pages should get the new field")
+	assert.NoError(t, index.Close())
+}
+
+func TestRebuildWhileClosing(t *testing.T) {
+	root, err := ioutil.TempDir("", "rebuild.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	pages := filepath.Join(root, "pages")
+	writeTestTree(t, pages, map[string]string{"page.md": "Title: Page\n\nbody\n"})
+
+	index, err := OpenIndex(IndexSection{
+		WatchDirs:      map[string]string{pages + "/": "/"},
+		WatchExtension: ".md",
+		IndexPath:      filepath.Join(root, "index"),
+		IndexType:      "en",
+		IndexName:      "wiki",
+	}, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rebuilt := make(chan error)
+	go func() { rebuilt <- index.Rebuild() }()
+	assert.NoError(t, index.Close())
+	<-rebuilt
+
+	err = index.Rebuild()
+	if e, ok := err.(*Error); assert.True(t, ok, "got [%v]", err) {
+		assert.Equal(t, ErrIndexClosing, e.Code, "a closed index should not rebuild")
+	}
+}
+
+func TestSortByTitleAndPath(t *testing.T) {
+	root, err := ioutil.TempDir("", "sort.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	pages := filepath.Join(root, "pages")
+	writeTestTree(t, pages, map[string]string{
+		"b/zebra.md": "Title: banana split\n\nbody\n",
+		"a/Zoo.md":   "Title: The Apple\n\nbody\n",
+		"C.md":       "Title: apple pie\n\nbody\n",
+	})
+
+	index, err := OpenIndex(IndexSection{
+		WatchDirs:      map[string]string{pages + "/": "/"},
+		WatchExtension: ".md",
+		IndexPath:      filepath.Join(root, "index"),
+		IndexType:      "en",
+		IndexName:      "wiki",
+	}, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	waitFor(t, "the first crawl", func() bool { return index.Stats().DocCount == 3 })
+
+	var tests = []struct {
+		sort     string
+		expected []string
+	}{
+		{"title", []string{"/C.md", "/b/zebra.md", "/a/Zoo.md"}},
+		{"-title", []string{"/a/Zoo.md", "/b/zebra.md", "/C.md"}},
+		{"path", []string{"/a/Zoo.md", "/b/zebra.md", "/C.md"}},
+	}
+	for _, testSet := range tests {
+		request := bleve.NewSearchRequest(bleve.NewMatchAllQuery())
+		request.SortBy(sortOrder(testSet.sort))
+		results, err := index.Query(request)
+		assert.NoError(t, err)
+		var order []string
+		for _, hit := range results.Hits {
+			order = append(order, hit.ID)
+		}
+		assert.Equal(t, testSet.expected, order, "sorted by [%s]", testSet.sort)
+	}
+}
+
+func TestWikiLinkIndexedFirst(t *testing.T) {
+	root, err := ioutil.TempDir("", "wikilink.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	pages := filepath.Join(root, "pages")
+	writeTestTree(t, pages, map[string]string{"linking.md": "Title: Linking\n\nsee [[Disk Usage]]\n"})
+
+	config := GlobalSection{Indexes: []IndexSection{{
+		WatchDirs:      map[string]string{pages + "/": "/"},
+		WatchExtension: ".md",
+		WatchDelay:     "50ms",
+		IndexPath:      filepath.Join(root, "index"),
+		IndexType:      "en",
+		IndexName:      "wiki",
+	}}}
+	index, err := OpenIndex(config.Indexes[0], log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	waitFor(t, "the first crawl", func() bool {
+		s := index.Stats()
+		return s.Watchers == 1 && s.DocCount == 1 && s.Crawling == 0
+	})
+
+	_, found := TitleLink(index, "Disk Usage", nil)
+	assert.False(t, found)
+	report, err := BrokenLinkReport(index, config, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []BrokenLinks{{Title: "Linking", URIPath: "/linking",
+		Links: []string{"[[disk usage]]"}}}, report.Pages)
+
+	// the page the link goes to only shows up after the page linking to it
+	time.Sleep(50 * time.Millisecond)
+	writeTestTree(t, pages, map[string]string{"runbooks/disk.md": "Title: Disk usage\n\nfull disks\n"})
+	var link string
+	waitFor(t, "the new page", func() bool {
+		link, found = TitleLink(index, "Disk Usage", nil)
+		return found
+	})
+	assert.Equal(t, "/runbooks/disk", link)
+
+	backlinks, err := Backlinks(index, "/runbooks/disk.md", "Disk usage", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []Backlink{{Title: "Linking", URIPath: "/linking"}}, backlinks)
+
+	report, err = BrokenLinkReport(index, config, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Pages, "the wiki link should resolve once the page is indexed")
+}
+
+func TestBrokenLinkReportViewer(t *testing.T) {
+	root, err := ioutil.TempDir("", "linkviewer.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	pages := filepath.Join(root, "pages")
+	writeTestTree(t, pages, map[string]string{
+		"open.md":     "Title: Open\n\n[gone](/gone.md)\n",
+		"internal.md": "Title: Internal\nTopic: internal\n\n[gone](/gone.md)\n",
+		"audit.md":    "Title: Audit\nAccess: security\n\n[gone](/gone.md)\n",
+	})
+
+	config := GlobalSection{Indexes: []IndexSection{{
+		WatchDirs:      map[string]string{pages + "/": "/"},
+		WatchExtension: ".md",
+		IndexPath:      filepath.Join(root, "index"),
+		IndexType:      "en",
+		IndexName:      "wiki",
+	}}}
+	openIndex := func(c IndexSection) Index {
+		index, err := OpenIndex(c, log.New(ioutil.Discard, "", 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "the first crawl", func() bool {
+			s := index.Stats()
+			return s.LastCrawl.After(time.Time{}) && s.Crawling == 0
+		})
+		return index
+	}
+	reported := func(index Index, viewer *User) []string {
+		report, err := BrokenLinkReport(index, config, viewer)
+		assert.NoError(t, err)
+		var titles []string
+		for _, page := range report.Pages {
+			titles = append(titles, page.Title)
+		}
+		return titles
+	}
+	jill := &User{Name: "jill"}
+	jack := &User{Name: "jack", Groups: []string{"ops"}}
+
+	index := openIndex(config.Indexes[0])
+	assert.Equal(t, []string{"Audit", "Internal", "Open"}, reported(index, nil))
+	assert.Equal(t, []string{"Internal", "Open"}, reported(index, jill))
+	assert.NoError(t, index.Close())
+
+	// none of the pages changed, but the internal topic is now limited
+	config.Indexes[0].TopicGroups = map[string][]string{"internal": {"ops"}}
+	index = openIndex(config.Indexes[0])
+	defer index.Close()
+	assert.Equal(t, []string{"Open"}, reported(index, jill),
+		"a change to TopicGroups should index every page again")
+	assert.Equal(t, []string{"Internal", "Open"}, reported(index, jack))
+}
+
+func TestFuzzySearchWholeTags(t *testing.T) {
+	root, err := ioutil.TempDir("", "fuzzytag.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	pages := filepath.Join(root, "pages")
+	writeTestTree(t, pages, map[string]string{
+		"lb.md":      "Title: Pools\nTopic: Load Balancing\n\nbody\n",
+		"load.md":    "Title: Load\nTopic: load\n\nbody\n",
+		"balance.md": "Title: Balance\nTopic: balancing\n\nbody\n",
+	})
+
+	index, err := OpenIndex(IndexSection{
+		WatchDirs:      map[string]string{pages + "/": "/"},
+		WatchExtension: ".md",
+		IndexPath:      filepath.Join(root, "index"),
+		IndexType:      "en",
+		IndexName:      "wiki",
+	}, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	waitFor(t, "the first crawl", func() bool { return index.Stats().DocCount == 3 })
+
+	// only the topic is searched
+	topicOnly := map[string]float64{"title": -1, "keyword": -1, "path": -1, "body": -1, "author": -1}
+	var tests = []struct {
+		term      string
+		fuzziness int
+		expected  []string
+	}{
+		{"Load  Balancing", -1, []string{"/lb"}},
+		{"load balancng", 1, []string{"/lb"}},
+		{"load balancng", -1, nil},
+		{"lead", 1, []string{"/load"}},
+	}
+	for _, testSet := range tests {
+		response, err := FuzzySearch(index, FuzzySearchValues{
+			Term:          testSet.term,
+			SearchOptions: SearchOptions{PageSize: 10},
+			Boosts:        topicOnly,
+			Fuzziness:     testSet.fuzziness,
+		})
+		assert.NoError(t, err)
+		var found []string
+		for _, result := range response.Results {
+			found = append(found, result.URIPath)
+		}
+		assert.Equal(t, testSet.expected, found,
+			"[%s] with fuzziness %d should match the whole topic", testSet.term, testSet.fuzziness)
+	}
+}
+
+func TestSearchResultKeywords(t *testing.T) {
+	root, err := ioutil.TempDir("", "keywords.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	pages := filepath.Join(root, "pages")
+	writeTestTree(t, pages, map[string]string{
+		"disk.md": "Title: Disk Usage\nTopic: linux\nKeyword: df\nKeyword: du\n\nfull disks\n",
+	})
+
+	index, err := OpenIndex(IndexSection{
+		WatchDirs:      map[string]string{pages + "/": "/"},
+		WatchExtension: ".md",
+		IndexPath:      filepath.Join(root, "index"),
+		IndexType:      "en",
+		IndexName:      "wiki",
+	}, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	waitFor(t, "the first crawl", func() bool { return index.Stats().DocCount == 1 })
+
+	opts := SearchOptions{PageSize: 10}
+	searches := map[string]func() (SearchResponse, error){
+		"fuzzy": func() (SearchResponse, error) {
+			return FuzzySearch(index, FuzzySearchValues{Term: "disk", SearchOptions: opts})
+		},
+		"query":  func() (SearchResponse, error) { return QuerySearch(index, "disks", opts) },
+		"field":  func() (SearchResponse, error) { return ListAllField(index, "topic", "linux", opts) },
+		"recent": func() (SearchResponse, error) { return RecentChanges(index, opts) },
+	}
+	for name, search := range searches {
+		response, err := search()
+		assert.NoError(t, err, "the %s search failed", name)
+		if assert.Len(t, response.Results, 1, "the %s search should find the page", name) {
+			assert.Equal(t, []string{"df", "du"}, response.Results[0].Keywords,
+				"the %s search should give the keywords", name)
+		}
+	}
+}
+
+func TestStatsWhileReopening(t *testing.T) {
+	root, err := ioutil.TempDir("", "stats.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	pages := filepath.Join(root, "pages")
+	writeTestTree(t, pages, map[string]string{"page.md": "Title: Page\n\nbody\n"})
+
+	section := IndexSection{
+		WatchDirs:      map[string]string{pages + "/": "/"},
+		WatchExtension: ".md",
+		IndexPath:      filepath.Join(root, "index"),
+		IndexType:      "en",
+		IndexName:      "wiki",
+	}
+	index, err := OpenIndex(section, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	// the admin page reads the stats while a reload reopens the index
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for count := 0; count < 3; count++ {
+			section.Restricted = []string{fmt.Sprintf("topic %d", count)}
+			assert.NoError(t, index.Reopen(section))
+		}
+	}()
+	for reopening := true; reopening; {
+		select {
+		case <-done:
+			reopening = false
+		default:
+			index.Stats()
+		}
+	}
+	assert.Equal(t, section.IndexPath, index.Stats().IndexPath)
+}
+
+func TestCustomDateFilter(t *testing.T) {
+	root, err := ioutil.TempDir("", "customdate.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	pages := filepath.Join(root, "pages")
+	writeTestTree(t, pages, map[string]string{
+		"june.md": "Title: June\nReview-By: 2017-06-01\n\nbody\n",
+		"july.md": "Title: July\nReview-By: 2017-07-15\n\nbody\n",
+	})
+
+	fields := []FieldSection{{Metadata: "Review-By", Field: "review", Type: fieldDate}}
+	index, err := OpenIndex(IndexSection{
+		WatchDirs:      map[string]string{pages + "/": "/"},
+		WatchExtension: ".md",
+		IndexPath:      filepath.Join(root, "index"),
+		IndexType:      "en",
+		IndexName:      "wiki",
+		Fields:         fields,
+	}, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	waitFor(t, "the first crawl", func() bool { return index.Stats().DocCount == 2 })
+
+	var tests = []struct {
+		query    string
+		expected []string
+	}{
+		{"custom.review=2017-06-01", []string{"/june"}},
+		{"custom.review=2017-07-01..", []string{"/july"}},
+		{"custom.review=..2017-06-30", []string{"/june"}},
+		{"custom.review=2017-06-02", nil},
+	}
+	for _, testSet := range tests {
+		form, err := url.ParseQuery(testSet.query)
+		assert.NoError(t, err)
+		opts, err := searchOptions(ServerSection{}, fields, form)
+		assert.NoError(t, err)
+		response, err := RecentChanges(index, opts)
+		assert.NoError(t, err)
+		var found []string
+		for _, result := range response.Results {
+			found = append(found, result.URIPath)
+		}
+		assert.Equal(t, testSet.expected, found, "[%s] found the wrong pages", testSet.query)
+	}
+}
+
+func TestDirectoryBacklinks(t *testing.T) {
+	root, err := ioutil.TempDir("", "dirlinks.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	pages := filepath.Join(root, "pages")
+	writeTestTree(t, pages, map[string]string{
+		"runbooks/index.md": "Title: Runbooks\n\n[disk](disk.md)\n",
+		"runbooks/disk.md":  "Title: Disk\n\n[all runbooks](./)\n",
+		"slash.md":          "Title: Slash\n\n[runbooks](/runbooks/)\n",
+		"bare.md":           "Title: Bare\n\n[runbooks](/runbooks)\n",
+		"full.md":           "Title: Full\n\n[runbooks](runbooks/index.md)\n",
+	})
+
+	index, err := OpenIndex(IndexSection{
+		WatchDirs:      map[string]string{pages + "/": "/"},
+		WatchExtension: ".md",
+		IndexPath:      filepath.Join(root, "index"),
+		IndexType:      "en",
+		IndexName:      "wiki",
+	}, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	waitFor(t, "the first crawl", func() bool { return index.Stats().DocCount == 5 })
+
+	backlinks, err := Backlinks(index, "/runbooks/index.md", "Runbooks", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []Backlink{
+		{Title: "Bare", URIPath: "/bare"},
+		{Title: "Disk", URIPath: "/runbooks/disk"},
+		{Title: "Full", URIPath: "/full"},
+		{Title: "Slash", URIPath: "/slash"},
+	}, backlinks, "every form of link to the directory should count")
+}
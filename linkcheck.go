@@ -0,0 +1,303 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/blevesearch/bleve"
+)
+
+// BrokenLinks are the links on one page that do not go to anything
+type BrokenLinks struct {
+	Title   string
+	URIPath string
+	Links   []string
+}
+
+// LinkReport lists every page with broken links, ordered by URI path
+type LinkReport struct {
+	Pages   []BrokenLinks
+	Checked int // pages looked at
+	Broken  int // broken links across all pages
+}
+
+// linkChecker decides if a link within the wiki goes to anything, using the
+//  handlers and WatchDirs of every index in the config. Wiki links are looked
+//  up with resolve.
+type linkChecker struct {
+	handlers  []ServerSection
+	watchDirs map[string]string // URI prefix -> file prefix
+	resolve   titleResolver
+}
+
+func newLinkChecker(c GlobalSection) *linkChecker {
+	l := &linkChecker{watchDirs: make(map[string]string)}
+	for _, index := range c.Indexes {
+		l.handlers = append(l.handlers, index.Handlers...)
+		for filePrefix, uriPrefix := range index.WatchDirs {
+			uriPrefix = path.Clean(uriPrefix)
+			if !strings.HasSuffix(uriPrefix, "/") {
+				uriPrefix += "/"
+			}
+			l.watchDirs[uriPrefix] = filepath.Clean(filePrefix)
+		}
+	}
+	return l
+}
+
+// exists checks if a link, as given by wikiLink, goes to anything. The most
+//  specific handler prefix decides - markdown and raw handlers need the file
+//  or directory they would serve, any other handler is taken as valid. Links
+//  outside of every handler need a file or directory in a WatchDir.
+func (l *linkChecker) exists(target string) bool {
+	var handler *ServerSection
+	for id, h := range l.handlers {
+		if strings.HasPrefix(target+"/", h.Prefix) &&
+			(handler == nil || len(h.Prefix) > len(handler.Prefix)) {
+			handler = &l.handlers[id]
+		}
+	}
+
+	if handler != nil {
+		rel := strings.TrimPrefix(target+"/", handler.Prefix)
+		rel = strings.TrimSuffix(rel, "/")
+		if rel == "" {
+			rel = handler.Default
+		}
+		switch handler.ServerType {
+		case "markdown":
+			return markdownExists(*handler, rel)
+		case "raw":
+			return isFile(filepath.Join(handler.Path, filepath.FromSlash(rel)))
+		default:
+			return true
+		}
+	}
+
+	var bestURI string
+	for uriPrefix := range l.watchDirs {
+		if strings.HasPrefix(target+"/", uriPrefix) && len(uriPrefix) > len(bestURI) {
+			bestURI = uriPrefix
+		}
+	}
+	if bestURI == "" {
+		return false
+	}
+	filePath := filepath.Join(l.watchDirs[bestURI],
+		filepath.FromSlash(strings.TrimPrefix(target, bestURI)))
+	return isFile(filePath) || isFile(filePath+".md") || isDir(filePath)
+}
+
+// markdownExists checks if a markdown handler would serve anything for rel -
+//  a page, or a directory with an index.md or a ListTemplate to list it
+func markdownExists(h ServerSection, rel string) bool {
+	filePath := filepath.Join(h.Path, filepath.FromSlash(rel))
+	if path.Ext(rel) == ".md" {
+		return isFile(filePath)
+	}
+	if isFile(filePath + ".md") {
+		return true
+	}
+	return isDir(filePath) &&
+		(isFile(filepath.Join(filePath, directoryIndex)) || h.ListTemplate != "")
+}
+
+func isDir(filePath string) bool {
+	info, err := os.Stat(filePath)
+	return err == nil && info.IsDir()
+}
+
+func isFile(filePath string) bool {
+	info, err := os.Stat(filePath)
+	return err == nil && !info.IsDir()
+}
+
+// add checks the links and wiki link titles of one page, and adds it to the
+//  report if any are broken. A broken wiki link is listed as [[title]].
+func (l *linkChecker) add(report *LinkReport, title, uriPath string,
+	links, titles []string) {
+	report.Checked++
+	var broken []string
+	for _, link := range links {
+		if !l.exists(link) {
+			broken = append(broken, link)
+		}
+	}
+	for _, wikiTitle := range titles {
+		if l.resolve == nil {
+			broken = append(broken, "[["+wikiTitle+"]]")
+		} else if _, found := l.resolve(wikiTitle); !found {
+			broken = append(broken, "[["+wikiTitle+"]]")
+		}
+	}
+	if len(broken) > 0 {
+		report.Pages = append(report.Pages, BrokenLinks{
+			Title:   title,
+			URIPath: uriPath,
+			Links:   broken,
+		})
+		report.Broken += len(broken)
+	}
+}
+
+func (report *LinkReport) sort() {
+	sort.Slice(report.Pages, func(a, b int) bool {
+		return report.Pages[a].URIPath < report.Pages[b].URIPath
+	})
+}
+
+// storedStrings reads a stored field that may hold one value or several
+func storedStrings(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var values []string
+		for _, each := range v {
+			if s, ok := each.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// BrokenLinkReport checks the links stored in the index for every page. Wiki
+//  links are looked up in the index as they are checked. With a viewer, only
+//  the pages they may see are reported, and wiki links only go to those.
+func BrokenLinkReport(i Index, c GlobalSection, viewer *User) (LinkReport, error) {
+	const pageSize = 500
+	checker := newLinkChecker(c)
+	checker.resolve = func(title string) (string, bool) {
+		return TitleLink(i, title, viewer)
+	}
+	visible := filterQuery(bleve.NewMatchAllQuery(), SearchFilters{Viewer: viewer})
+	var report LinkReport
+	for from := 0; ; from += pageSize {
+		request := bleve.NewSearchRequestOptions(visible, pageSize, from, false)
+		request.Fields = []string{"title", "path", "links", "wikilinks"}
+		result, err := i.Query(request)
+		if err != nil {
+			return LinkReport{}, err
+		}
+		for _, hit := range result.Hits {
+			title, _ := hit.Fields["title"].(string)
+			uriPath, _ := hit.Fields["path"].(string)
+			checker.add(&report, title, uriPath,
+				storedStrings(hit.Fields["links"]), storedStrings(hit.Fields["wikilinks"]))
+		}
+		if len(result.Hits) < pageSize {
+			break
+		}
+	}
+	report.sort()
+	return report, nil
+}
+
+// CheckLinks reads every page in the WatchDirs of the config straight from
+//  disk, skipping the same files the index would, and checks their links.
+//  Wiki links are checked against the titles of those same pages. No index
+//  is needed.
+func CheckLinks(c GlobalSection) (LinkReport, error) {
+	// the first page by path with each title, like TitleLink
+	titles := make(map[string]string)
+	err := walkPages(c, func(pdata *PageMetadata, uriPath string) {
+		key, uriPath := sortKey(pdata.Title), strings.TrimSuffix(uriPath, ".md")
+		if existing, ok := titles[key]; !ok || uriPath < existing {
+			titles[key] = uriPath
+		}
+	})
+	if err != nil {
+		return LinkReport{}, err
+	}
+
+	checker := newLinkChecker(c)
+	checker.resolve = func(title string) (string, bool) {
+		uriPath, found := titles[sortKey(title)]
+		return uriPath, found
+	}
+	var report LinkReport
+	err = walkPages(c, func(pdata *PageMetadata, uriPath string) {
+		links, titles := pageLinks(pdata.Page, uriPath)
+		checker.add(&report, pdata.Title, strings.TrimSuffix(uriPath, ".md"), links, titles)
+	})
+	if err != nil {
+		return LinkReport{}, err
+	}
+	report.sort()
+	return report, nil
+}
+
+// walkPages calls visit with every page in the WatchDirs of the config, read
+//  from disk, and the URI path it would be indexed at. The files the index
+//  would skip are skipped.
+func walkPages(c GlobalSection, visit func(pdata *PageMetadata, uriPath string)) error {
+	for _, index := range c.Indexes {
+		for filePrefix, uriPrefix := range index.WatchDirs {
+			filter, err := newFileFilter(index, filePrefix)
+			if err != nil {
+				return err
+			}
+			uriPrefix = strings.TrimSuffix(path.Clean(uriPrefix), "/")
+
+			err = filepath.Walk(filter.root, func(filePath string, info os.FileInfo, err error) error {
+				if err != nil {
+					return &Error{Code: ErrFileRead, value: filePath, innerError: err}
+				}
+				if filter.skip(filePath, info) {
+					if info.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				if info.IsDir() {
+					return nil
+				}
+
+				pdata := new(PageMetadata)
+				if err := pdata.LoadPage(filePath); err != nil {
+					// the index would skip this page too
+					log.Println(err)
+					return nil
+				}
+				if pdata.MatchedTopic(index.Restricted) {
+					return nil
+				}
+				rel, err := filepath.Rel(filter.root, filePath)
+				if err != nil {
+					return &Error{Code: ErrFileRead, value: filePath, innerError: err}
+				}
+				visit(pdata, uriPrefix+"/"+filepath.ToSlash(rel))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Write lists the broken links in the report as plain text
+func (report LinkReport) Write(w io.Writer) error {
+	for _, page := range report.Pages {
+		if _, err := fmt.Fprintf(w, "%s (%s)\n", page.URIPath, page.Title); err != nil {
+			return err
+		}
+		for _, link := range page.Links {
+			if _, err := fmt.Fprintf(w, "\t%s\n", link); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := fmt.Fprintf(w, "%d broken links on %d of %d pages\n",
+		report.Broken, len(report.Pages), report.Checked)
+	return err
+}
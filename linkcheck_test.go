@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckLinks(t *testing.T) {
+	root, err := ioutil.TempDir("", "checkLinks.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	files := map[string]string{
+		"readme.md": "Title: Readme\n\n[disk](runbooks/disk.md) and [gone](/old-page)\n" +
+			"[[Guides]] and [[Nowhere]]\n",
+		"runbooks/disk.md": "Title: Disk\n\n[home](/) [memory](memory) [search](/search/?s=disk)\n" +
+			"[diagram](/files/disk.png) [missing](/files/none.png)\n",
+		"files/disk.png":        "png",
+		"guides/index.md":       "Title: Guides\n\nevery guide\n",
+		"drafts/todo.md":        "Title: Todo\n\nlater\n",
+		"other/archive/2016.md": "Title: 2016\n\nold\n",
+	}
+	for name, contents := range files {
+		filePath := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filePath, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config := GlobalSection{Indexes: []IndexSection{{
+		WatchDirs:      map[string]string{root: "/"},
+		WatchExtension: ".md",
+		Handlers: []ServerSection{
+			{ServerType: "markdown", Prefix: "/", Path: root, Default: "readme"},
+			{ServerType: "raw", Prefix: "/files/", Path: filepath.Join(root, "files")},
+			{ServerType: "fuzzy", Prefix: "/search/"},
+		},
+	}}}
+
+	checker := newLinkChecker(config)
+	assert.True(t, checker.exists("/"), "the default page should be found")
+	assert.True(t, checker.exists("/runbooks/disk"))
+	assert.True(t, checker.exists("/files/disk.png"))
+	assert.True(t, checker.exists("/search"), "search handlers are always there")
+	assert.False(t, checker.exists("/runbooks/memory"))
+	assert.True(t, checker.exists("/guides"), "a directory with an index.md is served")
+	assert.False(t, checker.exists("/drafts"), "a directory without one is not, with no ListTemplate")
+
+	listed := newLinkChecker(GlobalSection{Indexes: []IndexSection{{Handlers: []ServerSection{
+		{ServerType: "markdown", Prefix: "/", Path: root, ListTemplate: "listing.html"}}}}})
+	assert.True(t, listed.exists("/drafts"), "a directory is listed with a ListTemplate")
+	assert.False(t, listed.exists("/nothing"))
+
+	watched := newLinkChecker(GlobalSection{Indexes: []IndexSection{{
+		WatchDirs: map[string]string{filepath.Join(root, "other"): "/other/"}}}})
+	assert.True(t, watched.exists("/other/archive"), "a directory in a WatchDir exists")
+
+	report, err := CheckLinks(config)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, report.Checked)
+	assert.Equal(t, 4, report.Broken)
+	assert.Equal(t, []BrokenLinks{
+		{Title: "Readme", URIPath: "/readme", Links: []string{"/old-page", "[[nowhere]]"}},
+		{Title: "Disk", URIPath: "/runbooks/disk",
+			Links: []string{"/files/none.png", "/runbooks/memory"}},
+	}, report.Pages)
+}
+
+func TestStoredStrings(t *testing.T) {
+	assert.Equal(t, []string{"/a"}, storedStrings("/a"))
+	assert.Equal(t, []string{"/a", "/b"}, storedStrings([]interface{}{"/a", "/b"}))
+	assert.Nil(t, storedStrings(nil))
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	tocRenderer "github.com/JackKnifed/goki/tocRenderer"
+	"github.com/blevesearch/bleve"
+	blevequery "github.com/blevesearch/bleve/search/query"
+)
+
+// the most backlinks listed for a page
+const maxBacklinks = 200
+
+// the search that wiki links to missing pages go to, if SearchURL is not set
+const defaultSearchURL = "/search/"
+
+// titleResolver gives the link for the page with the title in a wiki link.
+//  If there is no such page, found is false.
+type titleResolver func(title string) (link string, found bool)
+
+// Backlink is a page that links to the page being shown
+type Backlink struct {
+	Title   string
+	URIPath string
+}
+
+// linkRecorder is a blackfriday renderer that records the destination of
+//  every link in a page, and the title in every wiki link. Everything else is
+//  rendered as normal and thrown out.
+type linkRecorder struct {
+	tocRenderer.Renderer
+	links  []string
+	titles []string
+}
+
+func (l *linkRecorder) Link(out *bytes.Buffer, link, title, content []byte) {
+	l.links = append(l.links, string(link))
+}
+
+func (l *linkRecorder) AutoLink(out *bytes.Buffer, link []byte, kind int) {
+	l.links = append(l.links, string(link))
+}
+
+func (l *linkRecorder) WikiLink(out *bytes.Buffer, title, content []byte) {
+	l.titles = append(l.titles, string(title))
+}
+
+// pageLinks lists the pages within the wiki that a page links to. Each link
+//  is the URI path the page is indexed with, without the extension. Links to
+//  other sites, to the page itself, and repeated links are left out. Wiki
+//  links are given back as titles, as sortKey gives them - which page a title
+//  goes to can change, so it is only looked up when the link is used.
+func pageLinks(markdown []byte, uriPath string) (links, titles []string) {
+	recorder := &linkRecorder{Renderer: tocRenderer.HtmlRenderer(0, "", "")}
+	tocRenderer.Markdown(markdown, recorder, bodyExtensions)
+
+	seen := map[string]bool{pageURI(uriPath): true}
+	for _, link := range recorder.links {
+		target, ok := wikiLink(link, uriPath)
+		if ok && !seen[target] {
+			seen[target] = true
+			links = append(links, target)
+		}
+	}
+	sort.Strings(links)
+
+	seenTitles := make(map[string]bool)
+	for _, title := range recorder.titles {
+		title = sortKey(title)
+		if title != "" && !seenTitles[title] {
+			seenTitles[title] = true
+			titles = append(titles, title)
+		}
+	}
+	sort.Strings(titles)
+	return links, titles
+}
+
+// pageURI gives the URI path a page is linked to by - without the extension,
+//  and for a directory's index.md, the directory. Links and the pages they go
+//  to are both put in this form, so /dir/, /dir and /dir/index.md all link to
+//  the same page.
+func pageURI(uriPath string) string {
+	uriPath = strings.TrimSuffix(path.Clean(uriPath), ".md")
+	if path.Base(uriPath) == strings.TrimSuffix(directoryIndex, ".md") {
+		uriPath = path.Dir(uriPath)
+	}
+	return uriPath
+}
+
+// wikiLink resolves a link found in the page at uriPath to the URI path of
+//  the page it points to - see pageURI. It is not ok if the link goes to
+//  another site, or only to an anchor.
+func wikiLink(link, uriPath string) (string, bool) {
+	target, err := url.Parse(strings.TrimSpace(link))
+	if err != nil || target.Scheme != "" || target.Host != "" || target.Opaque != "" {
+		return "", false
+	}
+	if target.Path == "" {
+		return "", false
+	}
+
+	resolved := target.Path
+	if !strings.HasPrefix(resolved, "/") {
+		resolved = path.Join(path.Dir(uriPath), resolved)
+	}
+	return pageURI(resolved), true
+}
+
+// Backlinks lists the pages in the index that link to the page at uriPath,
+//  or to its title with a wiki link, ordered by title. With a viewer, only
+//  the pages they may see are listed.
+func Backlinks(i Index, uriPath, title string, viewer *User) ([]Backlink, error) {
+	self := pageURI(uriPath)
+	linked := bleve.NewTermQuery(self)
+	linked.SetField("links")
+	var query blevequery.Query = linked
+	if sortKey(title) != "" {
+		named := bleve.NewTermQuery(sortKey(title))
+		named.SetField("wikilinks")
+		query = bleve.NewDisjunctionQuery(linked, named)
+	}
+	searchRequest := bleve.NewSearchRequest(filterQuery(query, SearchFilters{Viewer: viewer}))
+	searchRequest.Fields = []string{"title", "path"}
+	searchRequest.Size = maxBacklinks
+	searchRequest.SortBy([]string{"title_sort", "path_sort"})
+
+	results, err := i.Query(searchRequest)
+	if err != nil {
+		return nil, &Error{Code: ErrInvalidQuery, innerError: err}
+	}
+
+	var backlinks []Backlink
+	for _, hit := range results.Hits {
+		title, _ := hit.Fields["title"].(string)
+		uri, _ := hit.Fields["path"].(string)
+		if pageURI(uri) == self {
+			// a page naming itself
+			continue
+		}
+		backlinks = append(backlinks, Backlink{Title: title, URIPath: uri})
+	}
+	return backlinks, nil
+}
+
+// TitleLink finds the page in the index with the given title, ignoring case,
+//  and gives its URI path. If several pages have the title, the first by
+//  path is used. With a viewer, only the pages they may see are looked at.
+func TitleLink(i Index, title string, viewer *User) (string, bool) {
+	query := bleve.NewTermQuery(sortKey(title))
+	query.SetField("title_sort")
+	searchRequest := bleve.NewSearchRequest(filterQuery(query, SearchFilters{Viewer: viewer}))
+	searchRequest.Fields = []string{"path"}
+	searchRequest.Size = 1
+	searchRequest.SortBy([]string{"path_sort"})
+
+	results, err := i.Query(searchRequest)
+	if err != nil || len(results.Hits) < 1 {
+		return "", false
+	}
+	uri, _ := results.Hits[0].Fields["path"].(string)
+	return uri, uri != ""
+}
+
+// wikiResolver resolves wiki links through the index, to the pages the
+//  viewer may see. A link to a missing page goes to a search for its title
+//  instead. Without an index, every page is missing.
+func wikiResolver(i Index, searchURL string, viewer *User) titleResolver {
+	if searchURL == "" {
+		searchURL = defaultSearchURL
+	}
+	return func(title string) (string, bool) {
+		if i != nil {
+			if link, found := TitleLink(i, title, viewer); found {
+				return link, true
+			}
+		}
+		return searchURL + "?" + url.Values{"s": {title}}.Encode(), false
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWikiLink(t *testing.T) {
+	var tests = []struct {
+		link   string
+		target string
+		ok     bool
+	}{
+		{"/runbooks/disk.md", "/runbooks/disk", true},
+		{"/runbooks/disk", "/runbooks/disk", true},
+		{"memory.md", "/runbooks/memory", true},
+		{"../index.md#top", "/", true},
+		{"/runbooks/", "/runbooks", true},
+		{"/runbooks/index", "/runbooks", true},
+		{"sub/index.md", "/runbooks/sub", true},
+		{"./sub/page?s=x", "/runbooks/sub/page", true},
+		{"/files/diagram.png", "/files/diagram.png", true},
+		{"https://example.com/page.md", "", false},
+		{"//example.com/page", "", false},
+		{"mailto:jack@example.com", "", false},
+		{"#section", "", false},
+		{"?s=disk", "", false},
+	}
+
+	for _, testSet := range tests {
+		target, ok := wikiLink(testSet.link, "/runbooks/disk.md")
+		assert.Equal(t, testSet.ok, ok, "[%q] was not sorted right", testSet.link)
+		assert.Equal(t, testSet.target, target, "[%q] went to the wrong page", testSet.link)
+	}
+}
+
+func TestPageLinks(t *testing.T) {
+	markdown := []byte(`# Disk usage
+
+See [memory](memory.md), [the index](/index.md) and [memory again](memory).
+Also [this page](#usage), [itself](disk.md) and <https://example.com/>.
+`)
+	links, titles := pageLinks(markdown, "/runbooks/disk.md")
+	assert.Equal(t, []string{"/", "/runbooks/memory"}, links)
+	assert.Nil(t, titles)
+
+	links, _ = pageLinks([]byte("[the runbooks](/runbooks/) and [again](./)"), "/runbooks/index.md")
+	assert.Nil(t, links, "a directory's index page linking to its directory links to itself")
+
+	links, titles = pageLinks([]byte("no links here"), "/page.md")
+	assert.Nil(t, links)
+	assert.Nil(t, titles)
+}
+
+func TestWikiLinks(t *testing.T) {
+	resolve := func(title string) (string, bool) {
+		if title == "Disk Usage" {
+			return "/runbooks/disk", true
+		}
+		return "/search/?s=" + title, false
+	}
+
+	var tests = []struct {
+		input  string
+		output string
+	}{
+		{"see [[Disk Usage]] first", `<p>see <a class="wiki-link" href="/runbooks/disk">Disk Usage</a> first</p>`},
+		{"see [[Disk Usage|the disk page]]", `<p>see <a class="wiki-link" href="/runbooks/disk">the disk page</a></p>`},
+		{"see [[ Disk Usage | ]]", `<p>see <a class="wiki-link" href="/runbooks/disk">Disk Usage</a></p>`},
+		{"see [[Memory]]", `<p>see <a class="wiki-link missing" href="/search/?s=Memory">Memory</a></p>`},
+		{"see [[<b>|x]]", `<p>see <a class="wiki-link missing" href="/search/?s=&lt;b&gt;">x</a></p>`},
+		{"see [[]] and [[a]b]]", `<p>see [[]] and [[a]b]]</p>`},
+		{"see [normal](/page)", `<p>see <a href="/page">normal</a></p>`},
+	}
+
+	for _, testSet := range tests {
+		output := strings.TrimSpace(string(bodyParseMarkdown([]byte(testSet.input), resolve)))
+		assert.Equal(t, testSet.output, output, "[%q] rendered wrong", testSet.input)
+	}
+
+	output := strings.TrimSpace(string(bodyParseMarkdown([]byte("see [[Disk Usage]]"), nil)))
+	assert.Equal(t, "<p>see Disk Usage</p>", output, "without a resolver, links should be text")
+
+	links, titles := pageLinks([]byte("[[Disk Usage]], [[Memory]] and [[disk usage|again]]"), "/index.md")
+	assert.Nil(t, links)
+	assert.Equal(t, []string{"disk usage", "memory"}, titles,
+		"wiki links should be kept as titles, whether they resolve or not")
+
+	link, found := wikiResolver(nil, "", nil)("Disk & Memory")
+	assert.False(t, found)
+	assert.Equal(t, "/search/?s=Disk+%26+Memory", link)
+}
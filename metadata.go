@@ -6,10 +6,12 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
-	"net/mail"
 	"os"
+	"path/filepath"
 	"sort"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/JackKnifed/blackfriday"
 	tocRenderer "github.com/JackKnifed/goki/tocRenderer"
@@ -19,29 +21,33 @@ type PageMetadata struct {
 	Keywords  map[string]bool
 	Topics    map[string]bool
 	Authors   map[string]bool
+	Access    map[string]bool     // groups given in the Access metadata
+	Custom    map[string][]string // any other metadata, keyed by lower cased name
 	Page      []byte
 	Title     string
 	FileStats os.FileInfo
 }
 
 const (
+	// the body is parsed with tocRenderer, which also has wiki links
 	bodyHtmlFlags = 0 |
-		blackfriday.HTML_USE_XHTML |
-		blackfriday.HTML_USE_SMARTYPANTS |
-		blackfriday.HTML_SMARTYPANTS_FRACTIONS |
-		blackfriday.HTML_SMARTYPANTS_LATEX_DASHES |
-		blackfriday.HTML_ALERT_BOXES
+		tocRenderer.HTML_USE_XHTML |
+		tocRenderer.HTML_USE_SMARTYPANTS |
+		tocRenderer.HTML_SMARTYPANTS_FRACTIONS |
+		tocRenderer.HTML_SMARTYPANTS_LATEX_DASHES |
+		tocRenderer.HTML_ALERT_BOXES
 
 	bodyExtensions = 0 |
-		blackfriday.EXTENSION_NO_INTRA_EMPHASIS |
-		blackfriday.EXTENSION_TABLES |
-		blackfriday.EXTENSION_FENCED_CODE |
-		blackfriday.EXTENSION_AUTOLINK |
-		blackfriday.EXTENSION_STRIKETHROUGH |
-		blackfriday.EXTENSION_SPACE_HEADERS |
-		blackfriday.EXTENSION_AUTO_HEADER_IDS |
-		blackfriday.EXTENSION_TITLEBLOCK |
-		blackfriday.EXTENSION_ALERT_BOXES
+		tocRenderer.EXTENSION_NO_INTRA_EMPHASIS |
+		tocRenderer.EXTENSION_TABLES |
+		tocRenderer.EXTENSION_FENCED_CODE |
+		tocRenderer.EXTENSION_AUTOLINK |
+		tocRenderer.EXTENSION_STRIKETHROUGH |
+		tocRenderer.EXTENSION_SPACE_HEADERS |
+		tocRenderer.EXTENSION_AUTO_HEADER_IDS |
+		tocRenderer.EXTENSION_TITLEBLOCK |
+		tocRenderer.EXTENSION_ALERT_BOXES |
+		tocRenderer.EXTENSION_WIKI_LINKS
 
 	tocHtmlFlags = 0 |
 		blackfriday.HTML_USE_XHTML |
@@ -97,65 +103,164 @@ func (pdata *PageMetadata) checkMatch(
 		return
 	}
 
-	input = bytes.Replace(input, []byte("\t"), []byte(" "), -1)
-
-	parts := bytes.Split(input, []byte(" "))
-	var cleanParts [][]byte
-
-	for _, piece := range parts {
-		if len(piece) > 0 {
-			cleanParts = append(cleanParts[:], piece)
-		}
-	}
-
-	key := bytes.Join(cleanParts, []byte("-"))
+	key := normalizeTag(string(input))
 
 	if *tracker != nil {
-		(*tracker)[string(key)] = true
+		(*tracker)[key] = true
 	} else {
-		*tracker = map[string]bool{string(key): true}
+		*tracker = map[string]bool{key: true}
 	}
 }
 
+// normalizeTag puts a topic, keyword, author, or group in the one form it is
+//  stored, compared, and indexed in - lower case, with the words separated by
+//  single spaces.
+func normalizeTag(tag string) string {
+	return strings.Join(strings.Fields(strings.ToLower(tag)), " ")
+}
+
+// convertArr normalizes each tag into a set, dropping empty ones
 func convertArr(in []string) map[string]bool {
 	out := make(map[string]bool)
 	for _, each := range in {
-		out[strings.ToLower(each)] = true
+		if tag := normalizeTag(each); tag != "" {
+			out[tag] = true
+		}
 	}
 	return out
 }
 
+// LoadPage reads a page, and the metadata at the top of it - see
+//  splitFrontMatter. Without a title in the metadata, the page is titled with
+//  the top level heading it starts with, or failing that its file name. The
+//  heading used as the title is cut out of the page, so it is not shown twice.
 func (pdata *PageMetadata) LoadPage(pageName string) error {
-	// open the file
-	f, err := os.Open(pageName)
+	contents, err := ioutil.ReadFile(pageName)
 	if err != nil {
 		return fmt.Errorf("problem opening file [%q] - %v", pageName, err)
 	}
-	defer f.Close()
 	pdata.FileStats, err = os.Stat(pageName)
 
-	parsed, err := mail.ReadMessage(f)
+	frontMatter, body, err := splitFrontMatter(contents)
 	if err != nil {
 		return fmt.Errorf("problem parsing page [%q] - %v", pageName, err)
 	}
+	meta := pageMeta(frontMatter)
+
+	pdata.Topics = convertArr(meta["topic"])
+	pdata.Authors = convertArr(meta["author"])
+	pdata.Keywords = convertArr(meta["keyword"])
+	pdata.Access = convertArr(meta["access"])
+	pdata.Custom = pageCustom(frontMatter)
+
+	start, end := pdata.isTitle(body)
+	if len(meta["title"]) > 0 && strings.TrimSpace(meta["title"][0]) != "" {
+		// the heading is only cut out if it repeats the title given
+		if !strings.EqualFold(pdata.Title, strings.TrimSpace(meta["title"][0])) {
+			end = 0
+		}
+		pdata.Title = strings.TrimSpace(meta["title"][0])
+	}
+	if end > 0 {
+		body = append(body[:start:start], body[end:]...)
+	}
+	if pdata.Title == "" {
+		pdata.Title = humanizeName(pageName)
+	}
 
-	pdata.Topics = convertArr(parsed.Header["Topic"])
-	pdata.Authors = convertArr(parsed.Header["Author"])
-	pdata.Keywords = convertArr(parsed.Header["Keyword"])
-	if len(parsed.Header["Title"]) > 0 {
-		pdata.Title = parsed.Header["Title"][0]
-	} else {
-		pdata.Title = pageName
+	pdata.Page = body
+
+	return nil
+}
+
+// isTitle checks if a page starts with a top level heading - see
+//  isOneLineTitle and isTwoLineTitle - and sets the page's title to it. Only
+//  blank lines may come before it. Where the heading starts and ends is given
+//  back, or 0, 0 if there is none.
+func (pdata *PageMetadata) isTitle(input []byte) (int, int) {
+	start := 0
+	for start < len(input) {
+		end := bytes.IndexByte(input[start:], '\n')
+		if end < 0 || len(bytes.TrimSpace(input[start:start+end])) > 0 {
+			break
+		}
+		start += end + 1
 	}
 
-	tempPage, err := ioutil.ReadAll(parsed.Body)
-	if err != nil {
-		return fmt.Errorf("problem reading page from parsed version - %v", err)
+	if length := pdata.isOneLineTitle(input[start:]); length > 0 {
+		return start, start + length
 	}
+	if length := pdata.isTwoLineTitle(input[start:]); length > 0 {
+		return start, start + length
+	}
+	return 0, 0
+}
 
-	pdata.Page = tempPage
+// isOneLineTitle checks if input starts with a top level # heading, and if so
+//  sets the title to it. The # has to be followed by a space, as it does for
+//  the page to render it as a heading. The length of the heading line is
+//  given back, or 0 if it is not a heading.
+func (pdata *PageMetadata) isOneLineTitle(input []byte) int {
+	line, length := input, len(input)
+	if end := bytes.IndexByte(input, '\n'); end >= 0 {
+		line, length = input[:end], end+1
+	}
+	line = bytes.TrimRight(line, " \t\r")
+	if !bytes.HasPrefix(line, []byte("# ")) && !bytes.HasPrefix(line, []byte("#\t")) {
+		return 0
+	}
 
-	return nil
+	text := bytes.TrimSpace(bytes.TrimRight(line[1:], "#"))
+	if len(text) == 0 {
+		return 0
+	}
+	pdata.Title = string(text)
+	return length
+}
+
+// isTwoLineTitle checks if input starts with a line underlined with =, and if
+//  so sets the title to it. Input has to start where a paragraph would, so
+//  the underlined line is the whole paragraph. The length of both lines is
+//  given back, or 0 if it is not a heading.
+func (pdata *PageMetadata) isTwoLineTitle(input []byte) int {
+	lines := bytes.SplitN(input, []byte("\n"), 3)
+	if len(lines) < 2 {
+		return 0
+	}
+	title := bytes.TrimSpace(lines[0])
+	underline := bytes.TrimSpace(lines[1])
+	if len(title) == 0 || len(underline) == 0 || len(bytes.Trim(underline, "=")) > 0 {
+		return 0
+	}
+
+	pdata.Title = string(title)
+	length := len(lines[0]) + 1 + len(lines[1])
+	if len(lines) == 3 {
+		length++
+	}
+	return length
+}
+
+// humanizeName turns the file name of a page into a title - disk-usage.md is
+//  Disk Usage. An index page is named after its directory.
+func humanizeName(pageName string) string {
+	name := filepath.Base(pageName)
+	if name == directoryIndex {
+		name = filepath.Base(filepath.Dir(pageName))
+	}
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+
+	words := strings.FieldsFunc(name, func(r rune) bool {
+		return r == '-' || r == '_' || unicode.IsSpace(r)
+	})
+	for id, word := range words {
+		first, size := utf8.DecodeRuneInString(word)
+		words[id] = string(unicode.ToUpper(first)) + word[size:]
+	}
+	if len(words) == 0 {
+		return pageName
+	}
+	return strings.Join(words, " ")
 }
 
 // given input, find where the next line starts
@@ -175,13 +280,39 @@ func (pdata *PageMetadata) findNextLine(input []byte) int {
 // if matched, returns true, otherwise false
 func (pdata *PageMetadata) MatchedTopic(checkTags []string) bool {
 	for _, tag := range checkTags {
-		if pdata.Topics[tag] == true {
+		if pdata.Topics[normalizeTag(tag)] == true {
 			return true
 		}
 	}
 	return false
 }
 
+// Groups lists the groups that may see the page - the groups in its Access
+//  metadata, and the groups its topics are given in topicGroups. A page
+//  without any groups may be seen by everyone.
+func (pdata *PageMetadata) Groups(topicGroups map[string][]string) []string {
+	found := make(map[string]bool)
+	for group := range pdata.Access {
+		found[group] = true
+	}
+	for topic, groups := range topicGroups {
+		if pdata.Topics[normalizeTag(topic)] {
+			for _, group := range groups {
+				if group = normalizeTag(group); group != "" {
+					found[group] = true
+				}
+			}
+		}
+	}
+
+	var groups []string
+	for group := range found {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	return groups
+}
+
 // returns all the tags within a list as an array of strings
 func (pdata *PageMetadata) ListMeta() (
 	topics []string, keywords []string, authors []string) {
@@ -198,14 +329,17 @@ func (pdata *PageMetadata) ListMeta() (
 	for oneAuthor, _ := range pdata.Authors {
 		authors = append(authors[:], oneAuthor)
 	}
-	sort.Strings(topics)
+	sort.Strings(authors)
 	return
 }
 
-func bodyParseMarkdown(input []byte) []byte {
+// bodyParseMarkdown renders the body of a page. Wiki links are resolved to
+//  a page with resolve, or written out as plain text if it is nil.
+func bodyParseMarkdown(input []byte, resolve titleResolver) []byte {
 	// set up the HTML renderer
-	renderer := blackfriday.HtmlRenderer(bodyHtmlFlags, "", "")
-	return blackfriday.Markdown(input, renderer, bodyExtensions)
+	renderer := tocRenderer.HtmlRendererWithParameters(bodyHtmlFlags, "", "",
+		tocRenderer.HtmlRendererParameters{WikiLinkResolver: resolve})
+	return tocRenderer.Markdown(input, renderer, bodyExtensions)
 }
 
 func tocParseMarkdown(input []byte) []byte {
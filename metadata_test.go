@@ -46,82 +46,109 @@ func TestWriteFileForTest(t *testing.T) {
 	assert.Equal(t, stringToWrite, string(fileContents), "file contents did not match")
 }
 
-// func TestIsTitle(t *testing.T) {
+func TestIsTitle(t *testing.T) {
+	var isTitleTests = []struct {
+		start         int
+		end           int
+		expectedTitle string
+		input         string
+	}{
+		{0, 0, "", "stuff\n# title"},
+		{0, 9, "title", "title\n==="},
+		{0, 8, "title", "# title\n\n"},
+		{1, 9, "title", "\n# title\n\n"},
+		{1, 12, "title", "\ntitle\n====\n\n"},
+		{0, 0, "", "intro text\n\nTwo Line\n========\nbody"},
+		{0, 0, "", "```\n# not a heading\n```\n# Real Heading"},
+		{0, 0, "", "\nTest Page\n"},
+		{0, 0, "", "## Details\nbody"},
+		{0, 0, "", "Details\n-------\nbody"},
+		{0, 0, "", "#tag\nbody"},
+		{0, 0, "", "first line\nsecond line\n===\nbody"},
+		{0, 0, "", "####### too deep\n"},
+	}
 
-// 	var isTitleTests = []struct {
-// 		expected      int
-// 		expectedTitle string
-// 		expectedTopic string
-// 		input         string
-// 	}{
-// 		{12, "title", "", "stuff\n#title"},
-// 		{9, "title", "", "title\n==="},
-// 		{7, "title", "", "#title\n\n"},
-// 		{8, "title", "", "\n#title\n\n"},
-// 		{1, "", "", "\ntitle\n====\n\n"},
-// 		{23, "title", "pageTopic", "topic:pageTopic\n#title\n\n"},
-// 		{22, "title", "pageTopic", "topic:pageTopic\n#title"},
-// 		{16, "", "pageTopic", "topic:pageTopic\ntitle is too late\n===="},
-// 		{1, "", "", "\nTest Page\n"},
-// 	}
+	for _, testSet := range isTitleTests {
+		pdata := new(PageMetadata)
+		start, end := pdata.isTitle([]byte(testSet.input))
+		assert.Equal(t, testSet.start, start, "[%q] - wrong start of the title", testSet.input)
+		assert.Equal(t, testSet.end, end, "[%q] - wrong end of the title", testSet.input)
+		assert.Equal(t, testSet.expectedTitle, pdata.Title, "[%q] - title not detected", testSet.input)
+	}
+}
 
-// 	for _, testSet := range isTitleTests {
-// 		pdata := new(PageMetadata)
-// 		assert.Equal(t, testSet.expected, pdata.isTitle([]byte(testSet.input)), "[%q] - wrong amount of characters discarded", testSet.input)
-// 		assert.Equal(t, testSet.expectedTitle, pdata.Title, "[%q] - title not detected", testSet.input)
-// 		assert.True(t, stringKeyExistsInMap(pdata.Topics, testSet.expectedTopic), "[%q] - metadata key not found", testSet.input)
-// 	}
-// }
+func TestIsOneLineTitle(t *testing.T) {
+	var isTitleTests = []struct {
+		expected      int
+		expectedTitle string
+		input         string
+	}{
+		{0, "", "#title\n"},
+		{8, "title", "# title\n"},
+		{7, "title", "# title"},
+		{8, "title", "#\ttitle\n"},
+		{0, "", "## title\n"},
+		{0, "", "\n# title\n\n"},
+		{0, "", "title#\n"},
+		{9, "yuup", "# yuup #\nother junk that should not matter"},
+		{16, "space stays", "# space stays #\nother junk that should not matter"},
+	}
 
-// func TestIsOneLineTitle(t *testing.T) {
-// 	var isTitleTests = []struct {
-// 		expected      int
-// 		expectedTitle string
-// 		input         string
-// 	}{
-// 		{7, "title", "#title\n"},
-// 		{6, "title", "#title"},
-// 		{0, "", "\n#title\n\n"},
-// 		{0, "", "title#\n"},
-// 		{9, "yuup", "# yuup #\nother junk that should not matter"},
-// 		{16, "space stays", "# space stays #\nother junk that should not matter"},
-// 	}
+	for _, testSet := range isTitleTests {
+		pdata := new(PageMetadata)
+		assert.Equal(t, testSet.expected, pdata.isOneLineTitle([]byte(testSet.input)),
+			"input was [%q]\nwrong amount of characters to discard", testSet.input)
+		assert.Equal(t, testSet.expectedTitle, pdata.Title,
+			"input was [%q]\ntitle not detected", testSet.input)
+	}
+}
 
-// 	for _, testSet := range isTitleTests {
-// 		pdata := new(PageMetadata)
-// 		assert.Equal(t, testSet.expected, pdata.isOneLineTitle([]byte(testSet.input)),
-// 			"input was [%q]\nwrong amount of characters to discard", testSet.input)
-// 		assert.Equal(t, testSet.expectedTitle, pdata.Title,
-// 			"input was [%q]\ntitle not detected", testSet.input)
-// 	}
-// }
+func TestIsTwoLineTitle(t *testing.T) {
+	var isTitleTests = []struct {
+		expected      int
+		expectedTitle string
+		input         string
+	}{
+		{0, "", "#title\n"},
+		{0, "", "#title"},
+		{0, "", "\ntitle\n====\n\n"},
+		{11, "title", "title\n====\n\n"},
+		{10, "title", "title\n===="},
+		{8, "title", "title\n=="},
+		{11, "title", "title\n====\nother stuff that should not matter"},
+		{0, "", "title\n----\nsecond level is not the title"},
+		{0, "", "title\n==--\n"},
+		{22, "three word title", "three word title\n====="},
+		{27, "space before", "\t    \t   space before\n====="},
+		{26, "space after", "space after\t    \t   \n====="},
+	}
 
-// func TestIsTwoLineTitle(t *testing.T) {
-// 	var isTitleTests = []struct {
-// 		expected      int
-// 		expectedTitle string
-// 		input         string
-// 	}{
-// 		{0, "", "#title\n"},
-// 		{0, "", "#title"},
-// 		{0, "", "\ntitle\n====\n\n"},
-// 		{11, "title", "title\n====\n\n"},
-// 		{10, "title", "title\n===="},
-// 		{8, "title", "title\n=="},
-// 		{11, "title", "title\n====\nother stuff that should not matter"},
-// 		{22, "three word title", "three word title\n====="},
-// 		{27, "space before", "\t    \t   space before\n====="},
-// 		{26, "space after", "space after\t    \t   \n====="},
-// 	}
+	for _, testSet := range isTitleTests {
+		pdata := new(PageMetadata)
+		assert.Equal(t, testSet.expected, pdata.isTwoLineTitle([]byte(testSet.input)),
+			"input was [%q]\nwrong amount of characters to discard", testSet.input)
+		assert.Equal(t, testSet.expectedTitle, pdata.Title,
+			"input was [%q]\ntitle not detected", testSet.input)
+	}
+}
 
-// 	for _, testSet := range isTitleTests {
-// 		pdata := new(PageMetadata)
-// 		assert.Equal(t, testSet.expected, pdata.isTwoLineTitle([]byte(testSet.input)),
-// 			"input was [%q]\nwrong amount of characters to discard", testSet.input)
-// 		assert.Equal(t, testSet.expectedTitle, pdata.Title,
-// 			"input was [%q]\ntitle not detected", testSet.input)
-// 	}
-// }
+func TestHumanizeName(t *testing.T) {
+	var humanizeTests = []struct {
+		input    string
+		expected string
+	}{
+		{"/srv/wiki/pages/foo.md", "Foo"},
+		{"/srv/wiki/disk-usage.md", "Disk Usage"},
+		{"ssl_cert  renewal.md", "Ssl Cert Renewal"},
+		{"runbooks/linux/index.md", "Linux"},
+		{"ÉTAT-des-lieux.md", "ÉTAT Des Lieux"},
+	}
+
+	for _, testSet := range humanizeTests {
+		assert.Equal(t, testSet.expected, humanizeName(testSet.input),
+			"input was [%q]", testSet.input)
+	}
+}
 
 func TestFindNextLine(t *testing.T) {
 	var isTitleTests = []struct {
@@ -153,11 +180,11 @@ func TestCheckMatch(t *testing.T) {
 		{true, "c", "topic=c"},
 		{true, "c", "topic=c"},
 		{true, "d-e-f", "topic=d-e-f"},
-		{true, "g-h", "topic=g  h"},
+		{true, "g h", "topic=g  h"},
 		{true, "i", "topic:i"},
 		{true, "j", "topic: j"},
 		{true, "k", "topic :k"},
-		{true, "l-m-no", "topic : l m   no"},
+		{true, "l m no", "topic : l m   no"},
 	}
 
 	for _, testSet := range checkMatchTests {
@@ -173,6 +200,32 @@ func TestCheckMatch(t *testing.T) {
 	}
 }
 
+func TestNormalizeTag(t *testing.T) {
+	var tests = []struct {
+		input    string
+		expected string
+	}{
+		{"linux", "linux"},
+		{"Linux", "linux"},
+		{"  SSL ", "ssl"},
+		{"Load Balancing", "load balancing"},
+		{"load\t  balancing", "load balancing"},
+		{"d-e-f", "d-e-f"},
+		{"Ünïcode", "ünïcode"},
+		{"ΣΟΦΙΑ", "σοφια"},
+		{"日本語 タグ", "日本語 タグ"},
+		{"\u00a0Straße\u00a0", "straße"},
+		{"   ", ""},
+	}
+	for _, testSet := range tests {
+		assert.Equal(t, testSet.expected, normalizeTag(testSet.input),
+			"tag [%q] was normalized wrong", testSet.input)
+	}
+
+	assert.Equal(t, map[string]bool{"load balancing": true, "ünïcode": true},
+		convertArr([]string{"Load  Balancing", "load balancing", "ÜNÏCODE", " "}))
+}
+
 // func TestProcessMetadata(t *testing.T) {
 // 	var checkProcessMetadata = []struct {
 // 		metaType string
@@ -224,34 +277,64 @@ func TestLoadPage(t *testing.T) {
 	}{
 		{
 			"\n\nTest Page\n=========\nsome test content\nand some more",
-			"\nTest Page\n=========\nsome test content\nand some more",
-			"", []string{}, []string{}, []string{}, "",
+			"\nsome test content\nand some more",
+			"Test Page", []string{}, []string{}, []string{}, "",
 		},
 		{
 			"keyword: junk\n\nsome other Page\n=========\nsome test content\nthere should be keywords",
-			"some other Page\n=========\nsome test content\nthere should be keywords",
-			"", []string{"junk"}, []string{}, []string{}, "",
+			"some test content\nthere should be keywords",
+			"some other Page", []string{"junk"}, []string{}, []string{}, "",
 		},
 		{
 			"keyword: junk\nkeyword: other junk\n\nsome other Page\n=========\nsome test content\nthere should be keywords",
-			"some other Page\n=========\nsome test content\nthere should be keywords",
-			"", []string{"junk", "other junk"}, []string{}, []string{}, "",
+			"some test content\nthere should be keywords",
+			"some other Page", []string{"junk", "other junk"}, []string{}, []string{}, "",
 		},
 		{
-			"keyword: junk\nkeyword: other junk\n\n#some other Page\nsome test content\nthere should be keywords",
-			"#some other Page\nsome test content\nthere should be keywords",
-			"", []string{"junk", "other junk"}, []string{}, []string{}, "",
+			"keyword: junk\nkeyword: other junk\n\n# some other Page\nsome test content\nthere should be keywords",
+			"some test content\nthere should be keywords",
+			"some other Page", []string{"junk", "other junk"}, []string{}, []string{}, "",
 		},
 		{
 			"keyword: junk\nkeyword: other junk\ntopic: very important\ntopic: internal\n\nsome other Page\n=========\nsome test content\nthere should be keywords",
-			"some other Page\n=========\nsome test content\nthere should be keywords",
-			"", []string{"junk", "other junk"}, []string{"very important", "internal"}, []string{}, "",
+			"some test content\nthere should be keywords",
+			"some other Page", []string{"junk", "other junk"}, []string{"very important", "internal"}, []string{}, "",
 		},
 		{
-			"junk page\nthat\nhas\nno\ntitle", "", "", []string{}, []string{}, []string{}, "need to hit a title in the file",
+			"junk page\nthat\nhas\nno\ntitle", "junk page\nthat\nhas\nno\ntitle",
+			"Testfile", []string{}, []string{}, []string{}, "",
 		},
 		{
-			"just a title\n=========", "", "", []string{}, []string{}, []string{}, "need to hit a title in the file",
+			"just a title\n=========", "",
+			"just a title", []string{}, []string{}, []string{}, "",
+		},
+		{
+			"Title: Given Title\n\n# given title\nbody", "body",
+			"Given Title", []string{}, []string{}, []string{}, "",
+		},
+		{
+			"---\ntitle: Front Matter\ntags: [linux, ssl]\n---\n# Heading\nbody",
+			"# Heading\nbody",
+			"Front Matter", []string{}, []string{"linux", "ssl"}, []string{}, "",
+		},
+		{
+			"---\ntitle: [unclosed\n", "---\ntitle: [unclosed\n", "Testfile", []string{}, []string{}, []string{}, "",
+		},
+		{
+			"+++\nkeywords = ['junk']\n+++\n## Second Level\nbody",
+			"## Second Level\nbody",
+			"Testfile", []string{"junk"}, []string{}, []string{}, "",
+		},
+		{
+			"# The Title\n\nintro\n\n## Details\nmore", "\nintro\n\n## Details\nmore",
+			"The Title", []string{}, []string{}, []string{}, "",
+		},
+		{
+			"intro\n\n## Details\nmore", "intro\n\n## Details\nmore",
+			"Testfile", []string{}, []string{}, []string{}, "",
+		},
+		{
+			"+++\nbroken line\n+++\nbody", "", "", []string{}, []string{}, []string{}, "front matter without an equals sign",
 		},
 	}
 
@@ -313,6 +396,11 @@ func TestMatchedTag(t *testing.T) {
 			[]string{},
 			[]string{"jester and joker", "kangaroo", "llama"},
 		},
+		{
+			map[string]bool{"internal": true, "tree frog": true, "ünïcode": true},
+			[]string{"Internal", "INTERNAL", "Tree  Frog", " tree frog ", "ÜNÏCODE"},
+			[]string{"tree-frog", "treefrog", "unicode"},
+		},
 	}
 	for _, testSet := range matchedTagTests {
 		pdata := new(PageMetadata)
@@ -348,6 +436,32 @@ func TestListMeta(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, []string(nil), allTopics, "I didn't get the empty topic list")
 	assert.Equal(t, []string(nil), allKeywords, "I didn't get the empty keyword list")
+
+	// test a page with authors out of order
+	filepath = writeFileForTest(t, "author: zed\nauthor: amy\nauthor: max\n\nsome other Page\n=========\n")
+	pdata = new(PageMetadata)
+	err = pdata.LoadPage(filepath)
+	_, _, allAuthors := pdata.ListMeta()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"amy", "max", "zed"}, allAuthors, "I didn't get the authors in order")
+}
+
+func TestLoadPageCustomHeaders(t *testing.T) {
+	// none of these are configured as Fields, and none may be dropped
+	filepath := writeFileForTest(t, "Title: Runbook\nTopic: Internal\nAccess: ops\nOwner: storage team\n"+
+		"Status: draft\nReview-By: 2017-06-01\n\nbody")
+	pdata := new(PageMetadata)
+	assert.NoError(t, pdata.LoadPage(filepath))
+
+	assert.Equal(t, "Runbook", pdata.Title)
+	assert.True(t, pdata.MatchedTopic([]string{"internal"}), "the topic should be kept")
+	assert.Equal(t, []string{"ops"}, pdata.Groups(nil), "the access groups should be kept")
+	assert.Equal(t, map[string][]string{
+		"owner":     {"storage team"},
+		"status":    {"draft"},
+		"review-by": {"2017-06-01"},
+	}, pdata.Custom, "every other header should be custom metadata")
+	assert.Equal(t, "body", string(pdata.Page))
 }
 
 func TestBodyParseMarkdown(t *testing.T) {
@@ -379,7 +493,7 @@ func TestBodyParseMarkdown(t *testing.T) {
 			return
 		}
 
-		cleanData := bodyParseMarkdown(rawData)
+		cleanData := bodyParseMarkdown(rawData, nil)
 		if bytes.Compare(cleanData, expectedData) != 0 {
 			f, err := ioutil.TempFile("", "bodyParseMarkdown.")
 			if err != nil {
@@ -3,54 +3,301 @@ package main
 import (
 	"log"
 	"net/http"
+	"os"
+	"reflect"
+	"sync"
+	"time"
 
 	"github.com/gorilla/handlers"
 )
 
+// IndexSet keeps track of every index opened by BuildMuxer, keyed by
+//  IndexPath, so that a rebuilt muxer can reuse indexes whose config did not
+//  change. Once closer is closed, every index is closed and marked done in
+//  closed.
+type IndexSet struct {
+	lock    sync.Mutex
+	open    map[string]openIndex
+	closing bool
+	logs    *log.Logger
+}
+
+type openIndex struct {
+	config IndexSection
+	index  Index
+}
+
+// NewIndexSet creates an empty IndexSet that closes itself with closer
+func NewIndexSet(closer <-chan struct{}, closed *sync.WaitGroup,
+	logs *log.Logger) *IndexSet {
+	s := &IndexSet{open: make(map[string]openIndex), logs: logs}
+
+	closed.Add(1)
+	go func() {
+		defer closed.Done()
+		<-closer
+		s.closeAll()
+	}()
+
+	return s
+}
+
+// sameIndex checks if two index sections would open the same index - the
+//  handlers underneath do not matter.
+func sameIndex(a, b IndexSection) bool {
+	a.Handlers, b.Handlers = nil, nil
+	return reflect.DeepEqual(a, b)
+}
+
+// Open gives back the index for a section, reusing the one that is already
+//  open at its IndexPath. Nothing that is open is closed or changed here, as
+//  the handlers being served may still be using it - if the section changed,
+//  it is only checked, and Prune switches the index over once the new
+//  handlers are in place.
+func (s *IndexSet) Open(c IndexSection) (Index, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closing {
+		return nil, &Error{Code: ErrIndexClosing, value: c.IndexPath}
+	}
+
+	if existing, ok := s.open[c.IndexPath]; ok {
+		if sameIndex(existing.config, c) {
+			return existing.index, nil
+		}
+		if err := checkIndexSection(c); err != nil {
+			return nil, err
+		}
+		return existing.index, nil
+	}
+
+	index, err := OpenIndex(c, s.logs)
+	if err != nil {
+		return nil, err
+	}
+	s.open[c.IndexPath] = openIndex{config: c, index: index}
+	return index, nil
+}
+
+// Prune brings the open indexes in line with the given sections, once the
+//  handlers using them are being served. An index whose section changed is
+//  reopened with the new section, and an index no section uses is closed.
+func (s *IndexSet) Prune(keep []IndexSection) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for indexPath, existing := range s.open {
+		var used *IndexSection
+		for id, c := range keep {
+			if c.IndexPath == indexPath {
+				used = &keep[id]
+			}
+		}
+
+		switch {
+		case used == nil:
+			s.logs.Printf("index [%s] no longer in use, closing", indexPath)
+			if err := existing.index.Close(); err != nil {
+				s.logs.Println(err)
+			}
+			delete(s.open, indexPath)
+		case !sameIndex(existing.config, *used):
+			s.logs.Printf("config for index [%s] changed, reopening", indexPath)
+			if err := existing.index.Reopen(*used); err != nil {
+				s.logs.Println(err)
+				continue
+			}
+			s.open[indexPath] = openIndex{config: *used, index: existing.index}
+		}
+	}
+}
+
+func (s *IndexSet) closeAll() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.closing = true
+	for indexPath, existing := range s.open {
+		if err := existing.index.Close(); err != nil {
+			s.logs.Println(err)
+		}
+		delete(s.open, indexPath)
+	}
+}
+
+// checkPrefixes makes sure every redirect and handler has a prefix, and that
+//  no two share one - the muxer would panic on either.
+func checkPrefixes(c GlobalSection) error {
+	seen := make(map[string]bool)
+	check := func(prefix string) error {
+		switch {
+		case prefix == "":
+			return &Error{Code: ErrBadPrefix, path: prefix, value: "is empty"}
+		case seen[prefix]:
+			return &Error{Code: ErrBadPrefix, path: prefix, value: "is used more than once"}
+		}
+		seen[prefix] = true
+		return nil
+	}
+
+	for _, r := range c.Redirects {
+		if err := check(r.Requested); err != nil {
+			return err
+		}
+	}
+	for _, i := range c.Indexes {
+		for _, h := range i.Handlers {
+			if err := check(h.Prefix); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // BuildMuxer builds a handler by:
 // * Opening Indexes
 // * Adding all handlers under an index
 // * Eventually putting all of the handlers together
-func BuildMuxer(c GlobalSection, closer <-chan struct{},
-	logs *log.Logger) (http.Handler, error) {
+// Indexes are opened through the IndexSet, so unchanged indexes are reused.
+//  If anything goes wrong, including the muxer panicking, an error is
+//  returned instead.
+func BuildMuxer(c GlobalSection, indexes *IndexSet,
+	logs *log.Logger) (h http.Handler, err error) {
+	if err := checkPrefixes(c); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			h, err = nil, &Error{Code: ErrBuildMuxer, value: p}
+		}
+	}()
+
 	m := http.NewServeMux()
-	// ## TODO ## return an error instead of panic if overlapping muxes
 	for _, r := range c.Redirects {
 		m.Handle(r.Requested,
 			http.RedirectHandler(r.Target, r.Code))
 	}
 
+	auth, err := NewAuthenticator(c.Auth)
+	if err != nil {
+		return nil, err
+	}
+
 	for _, i := range c.Indexes {
 		var index Index
-		var err error
 		if i.IndexPath != "" {
-			index, err = OpenIndex(i, logs)
+			index, err = indexes.Open(i)
 			if err != nil {
 				return nil, err
 			}
-
-			go func() {
-				<-closer
-				logs.Println(index.Close())
-			}()
 		}
+		access := &accessControl{auth: auth, topicGroups: i.TopicGroups}
 
 		for _, h := range i.Handlers {
 			switch h.ServerType {
 			case "markdown":
-				m.Handle(h.Prefix, http.StripPrefix(h.Prefix, Markdown{c: h}))
+				m.Handle(h.Prefix, http.StripPrefix(h.Prefix, Markdown{c: h, i: index, related: newRelatedCache(), a: access}))
 			case "raw":
-				m.Handle(h.Prefix, http.StripPrefix(h.Prefix, RawFile{c: h}))
+				m.Handle(h.Prefix, http.StripPrefix(h.Prefix, RawFile{c: h, a: access}))
 			case "query":
-				m.Handle(h.Prefix, http.StripPrefix(h.Prefix, QueryHandler{c: h, i: index}))
+				m.Handle(h.Prefix, http.StripPrefix(h.Prefix, QueryHandler{c: h, i: index, a: access, f: i.Fields}))
 			case "field":
-				m.Handle(h.Prefix, http.StripPrefix(h.Prefix, FieldsHandler{c: h, i: index}))
+				m.Handle(h.Prefix, http.StripPrefix(h.Prefix, FieldsHandler{c: h, i: index, a: access, f: i.Fields}))
 			case "fuzzy":
-				m.Handle(h.Prefix, http.StripPrefix(h.Prefix, FuzzyHandler{c: h, i: index}))
+				m.Handle(h.Prefix, http.StripPrefix(h.Prefix, FuzzyHandler{c: h, i: index, a: access, f: i.Fields}))
+			case "recent":
+				m.Handle(h.Prefix, http.StripPrefix(h.Prefix, RecentHandler{c: h, i: index, a: access, f: i.Fields}))
+			case "links":
+				m.Handle(h.Prefix, http.StripPrefix(h.Prefix, LinkReportHandler{c: h, i: index, a: access}))
+			case "admin":
+				m.Handle(h.Prefix, http.StripPrefix(h.Prefix,
+					requireGroup(auth, h.AdminGroup, AdminHandler{c: h, i: index})))
 			}
 		}
 	}
 
-	h := handlers.CompressHandler(m)
-	return h, nil
+	return handlers.CompressHandler(m), nil
+}
+
+// BuildHandler builds the muxer, and wraps it in request logging and the
+//  canonical host redirect.
+func BuildHandler(c GlobalSection, indexes *IndexSet,
+	logs *log.Logger) (http.Handler, error) {
+	mux, err := BuildMuxer(c, indexes, logs)
+	if err != nil {
+		return nil, err
+	}
+
+	mux = handlers.LoggingHandler(os.Stdout, mux)
+	canonical := handlers.CanonicalHost(c.Hostname, http.StatusMovedPermanently)
+	return canonical(mux), nil
+}
+
+// the group a user has to be in to use the admin handler, if none is set
+const defaultAdminGroup = "admin"
+
+// requireGroup wraps a handler so only users in group, as the Authenticator
+//  sees them, can use it. Anyone else is asked to log in, or refused.
+func requireGroup(auth Authenticator, group string, h http.Handler) http.Handler {
+	if group == "" {
+		group = defaultAdminGroup
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := auth.Authenticate(r)
+		switch {
+		case user.Name == "":
+			auth.Challenge(w)
+		case !user.inAny([]string{group}):
+			log.Printf("request [ %s ] is not open to [ %s ]", r.URL.Path, user.Name)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		default:
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
+// the longest Swap waits for requests to the old handler to finish
+const swapDrainTimeout = 30 * time.Second
+
+// SwappableHandler is a http.Handler that passes requests to a handler that
+//  can be safely replaced while serving.
+type SwappableHandler struct {
+	lock    sync.RWMutex
+	h       http.Handler
+	serving *sync.WaitGroup // requests being served by h
+}
+
+func (s *SwappableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.RLock()
+	h, serving := s.h, s.serving
+	serving.Add(1)
+	s.lock.RUnlock()
+
+	defer serving.Done()
+	h.ServeHTTP(w, r)
+}
+
+// Swap replaces the handler requests are passed to, then waits for the
+//  requests the old handler is still serving to finish - for up to
+//  swapDrainTimeout - so whatever the old handler uses can be closed after.
+func (s *SwappableHandler) Swap(h http.Handler) {
+	s.lock.Lock()
+	old := s.serving
+	s.h, s.serving = h, new(sync.WaitGroup)
+	s.lock.Unlock()
+
+	if old == nil {
+		return
+	}
+	drained := make(chan struct{})
+	go func() {
+		old.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(swapDrainTimeout):
+	}
 }
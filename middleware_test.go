@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSameIndex(t *testing.T) {
+	base := IndexSection{
+		WatchDirs:      map[string]string{"/var/www/": "/"},
+		WatchExtension: ".md",
+		IndexPath:      "/index/",
+		IndexType:      "en",
+		IndexName:      "wiki",
+		Handlers:       []ServerSection{{ServerType: "fuzzy", Prefix: "/search/"}},
+	}
+
+	handlersChanged := base
+	handlersChanged.Handlers = []ServerSection{{ServerType: "field", Prefix: "/topic/"}}
+	assert.True(t, sameIndex(base, handlersChanged), "handlers should not matter")
+
+	dirsChanged := base
+	dirsChanged.WatchDirs = map[string]string{"/var/www/": "/wiki/"}
+	assert.False(t, sameIndex(base, dirsChanged), "changed WatchDirs should reopen")
+
+	restrictChanged := base
+	restrictChanged.Restricted = []string{"internal"}
+	assert.False(t, sameIndex(base, restrictChanged), "changed Restricted should reopen")
+}
+
+func TestSwappableHandler(t *testing.T) {
+	respond := func(s string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, s)
+		})
+	}
+
+	h := new(SwappableHandler)
+	h.Swap(respond("first"))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, "first", w.Body.String())
+
+	h.Swap(respond("second"))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, "second", w.Body.String())
+}
+
+func TestRequireGroup(t *testing.T) {
+	proxy, err := NewAuthenticator(AuthSection{
+		Type:           "proxy",
+		UserHeader:     "X-User",
+		GroupHeader:    "X-Groups",
+		TrustedProxies: []string{"192.0.2.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		auth     Authenticator
+		group    string
+		user     string
+		groups   string
+		expected int
+	}{
+		{proxy, "", "jack", "admin", http.StatusOK},
+		{proxy, "", "jill", "ops", http.StatusForbidden},
+		{proxy, "", "", "", http.StatusUnauthorized},
+		{proxy, "Ops", "jill", "web, ops", http.StatusOK},
+		{proxy, "ops", "jack", "admin", http.StatusForbidden},
+		{anonymousAuth{}, "", "jack", "admin", http.StatusNotFound},
+	}
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for _, testSet := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-User", testSet.user)
+		r.Header.Set("X-Groups", testSet.groups)
+		requireGroup(testSet.auth, testSet.group, ok).ServeHTTP(w, r)
+		assert.Equal(t, testSet.expected, w.Code,
+			"user [%q] in [%q] got the wrong response", testSet.user, testSet.groups)
+	}
+}
+
+func TestSwappableHandlerDrains(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+
+	h := new(SwappableHandler)
+	h.Swap(slow)
+	go h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	<-started
+
+	swapped := make(chan struct{})
+	go func() {
+		h.Swap(http.NotFoundHandler())
+		close(swapped)
+	}()
+
+	select {
+	case <-swapped:
+		t.Fatal("swap returned while the old handler was still serving")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-swapped
+}
+
+func TestCheckPrefixes(t *testing.T) {
+	var tests = []struct {
+		config   GlobalSection
+		expected bool
+	}{
+		{GlobalSection{
+			Redirects: []RedirectSection{{Requested: "/old/", Target: "/new/"}},
+			Indexes: []IndexSection{{Handlers: []ServerSection{
+				{Prefix: "/new/"}, {Prefix: "/search/"}}}},
+		}, true},
+		{GlobalSection{Indexes: []IndexSection{
+			{Handlers: []ServerSection{{Prefix: "/wiki/"}}},
+			{Handlers: []ServerSection{{Prefix: "/wiki/"}}},
+		}}, false},
+		{GlobalSection{
+			Redirects: []RedirectSection{{Requested: "/wiki/"}},
+			Indexes:   []IndexSection{{Handlers: []ServerSection{{Prefix: "/wiki/"}}}},
+		}, false},
+		{GlobalSection{Indexes: []IndexSection{{Handlers: []ServerSection{{Prefix: ""}}}}}, false},
+	}
+	for id, testSet := range tests {
+		err := checkPrefixes(testSet.config)
+		assert.Equal(t, testSet.expected, err == nil, "test %d got [%v]", id, err)
+		if !testSet.expected {
+			_, err = BuildMuxer(testSet.config, nil, nil)
+			assert.Error(t, err, "test %d should not build", id)
+		}
+	}
+}
+
+func TestIndexSetReopen(t *testing.T) {
+	root, err := ioutil.TempDir("", "indexset.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	closer := make(chan struct{})
+	var closed sync.WaitGroup
+	defer closed.Wait()
+	defer close(closer)
+	logs := log.New(ioutil.Discard, "", 0)
+	indexes := NewIndexSet(closer, &closed, logs)
+
+	section := IndexSection{
+		WatchDirs:      map[string]string{root: "/"},
+		WatchExtension: ".md",
+		IndexPath:      filepath.Join(root, "index"),
+		IndexType:      "en",
+		IndexName:      "wiki",
+	}
+	first, err := indexes.Open(section)
+	assert.NoError(t, err)
+
+	changed := section
+	changed.Restricted = []string{"internal"}
+	second, err := indexes.Open(changed)
+	assert.NoError(t, err)
+	assert.True(t, first == second, "a changed index should stay open until it is pruned")
+
+	broken := section
+	broken.WatchDelay = "soon"
+	_, err = indexes.Open(broken)
+	assert.Error(t, err, "a bad section should be caught before the swap")
+
+	indexes.Prune([]IndexSection{changed})
+	indexes.lock.Lock()
+	assert.Equal(t, changed.Restricted, indexes.open[section.IndexPath].config.Restricted,
+		"pruning should switch the index over to the new section")
+	indexes.lock.Unlock()
+
+	indexes.Prune(nil)
+	indexes.lock.Lock()
+	assert.Empty(t, indexes.open, "an index no section uses should be closed")
+	indexes.lock.Unlock()
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/JackKnifed/blackfriday"
+	blackfridaytext "github.com/JackKnifed/blackfriday-text"
+	"github.com/blevesearch/bleve"
+	blevequery "github.com/blevesearch/bleve/search/query"
+)
+
+// the related pages listed on each page when RelatedCount is not set
+const defaultRelatedCount = 5
+
+// the most body terms a page is compared to other pages with
+const relatedTerms = 10
+
+// how much more sharing a topic or keyword counts than sharing a body term
+const (
+	relatedTopicBoost   = 3
+	relatedKeywordBoost = 2
+)
+
+// words too common to say anything about what a page is about
+var commonWords = map[string]bool{
+	"about": true, "after": true, "also": true, "because": true, "been": true,
+	"before": true, "being": true, "could": true, "does": true, "each": true,
+	"from": true, "have": true, "here": true, "into": true, "just": true,
+	"like": true, "make": true, "more": true, "most": true, "much": true,
+	"only": true, "other": true, "over": true, "same": true, "should": true,
+	"some": true, "such": true, "than": true, "that": true, "their": true,
+	"them": true, "then": true, "there": true, "these": true, "they": true,
+	"this": true, "those": true, "through": true, "very": true, "want": true,
+	"were": true, "what": true, "when": true, "where": true, "which": true,
+	"while": true, "will": true, "with": true, "would": true, "your": true,
+}
+
+// RelatedPage is another page with topics, keywords, or words in common
+type RelatedPage struct {
+	Title   string
+	URIPath string
+}
+
+// relatedCount gives the related pages a handler lists, which is none if
+//  RelatedCount is negative
+func relatedCount(c ServerSection) int {
+	switch {
+	case c.RelatedCount < 0:
+		return 0
+	case c.RelatedCount == 0:
+		return defaultRelatedCount
+	}
+	return c.RelatedCount
+}
+
+// topTerms gives the words used most in the text, leaving out short and
+//  common words. Ties are broken alphabetically.
+func topTerms(text string, count int) []string {
+	counts := make(map[string]int)
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !isWordRune(r)
+	}) {
+		if len([]rune(word)) < 4 || commonWords[word] || unicode.IsDigit([]rune(word)[0]) {
+			continue
+		}
+		counts[word]++
+	}
+
+	var terms []string
+	for word := range counts {
+		terms = append(terms, word)
+	}
+	sort.Slice(terms, func(a, b int) bool {
+		if counts[terms[a]] != counts[terms[b]] {
+			return counts[terms[a]] > counts[terms[b]]
+		}
+		return terms[a] < terms[b]
+	})
+	if len(terms) > count {
+		terms = terms[:count]
+	}
+	return terms
+}
+
+// relatedQuery matches pages sharing any of the topics, keywords, or terms.
+//  It is nil if there is nothing to compare with.
+func relatedQuery(topics, keywords, terms []string) blevequery.Query {
+	var queries []blevequery.Query
+	for _, topic := range topics {
+		query := bleve.NewMatchQuery(topic)
+		query.SetField("topic")
+		query.SetBoost(relatedTopicBoost)
+		queries = append(queries, query)
+	}
+	for _, keyword := range keywords {
+		query := bleve.NewMatchQuery(keyword)
+		query.SetField("keyword")
+		query.SetBoost(relatedKeywordBoost)
+		queries = append(queries, query)
+	}
+	if len(terms) > 0 {
+		query := bleve.NewMatchQuery(strings.Join(terms, " "))
+		query.SetField("body")
+		queries = append(queries, query)
+	}
+
+	if len(queries) == 0 {
+		return nil
+	}
+	disjunction := bleve.NewDisjunctionQuery(queries...)
+	disjunction.SetMin(1)
+	return disjunction
+}
+
+// RelatedPages finds the pages in the index most like the page at uriPath,
+//  leaving that page out. With a viewer, only the pages they may see are
+//  found.
+func RelatedPages(i Index, uriPath string, pdata *PageMetadata, count int,
+	viewer *User) ([]RelatedPage, error) {
+	if count <= 0 {
+		return nil, nil
+	}
+
+	topics, keywords, _ := pdata.ListMeta()
+	body := blackfriday.Markdown(pdata.Page, blackfridaytext.TextRenderer(),
+		blackfriday.EXTENSION_ALERT_BOXES)
+	query := relatedQuery(topics, keywords, topTerms(string(body), relatedTerms))
+	if query == nil {
+		return nil, nil
+	}
+
+	// one extra, in case the page itself is in the results
+	searchRequest := bleve.NewSearchRequest(filterQuery(query, SearchFilters{Viewer: viewer}))
+	searchRequest.Fields = []string{"title", "path"}
+	searchRequest.Size = count + 1
+
+	results, err := i.Query(searchRequest)
+	if err != nil {
+		return nil, &Error{Code: ErrInvalidQuery, innerError: err}
+	}
+
+	var related []RelatedPage
+	for _, hit := range results.Hits {
+		if hit.ID == uriPath || len(related) >= count {
+			continue
+		}
+		title, _ := hit.Fields["title"].(string)
+		uri, _ := hit.Fields["path"].(string)
+		related = append(related, RelatedPage{Title: title, URIPath: uri})
+	}
+	return related, nil
+}
+
+// relatedCache keeps the related pages found for each page, until the index
+//  changes
+type relatedCache struct {
+	lock    sync.Mutex
+	changes uint64
+	pages   map[string][]RelatedPage
+}
+
+func newRelatedCache() *relatedCache {
+	return &relatedCache{pages: make(map[string][]RelatedPage)}
+}
+
+// get gives the cached related pages for uriPath, or finds and caches them
+func (c *relatedCache) get(i Index, uriPath string,
+	find func() ([]RelatedPage, error)) ([]RelatedPage, error) {
+	changes := i.Changes()
+
+	c.lock.Lock()
+	if changes != c.changes {
+		c.pages = make(map[string][]RelatedPage)
+		c.changes = changes
+	}
+	related, ok := c.pages[uriPath]
+	c.lock.Unlock()
+	if ok {
+		return related, nil
+	}
+
+	related, err := find()
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	// the index may have changed while looking
+	if changes == c.changes {
+		c.pages[uriPath] = related
+	}
+	c.lock.Unlock()
+	return related, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopTerms(t *testing.T) {
+	text := "Disk usage: check the disk, then the disks. This disk is FULL, full of logs from 2017."
+	assert.Equal(t, []string{"disk", "full", "check", "disks"}, topTerms(text, 4))
+	assert.Nil(t, topTerms("a an the this that", 4), "short and common words should be left out")
+}
+
+func TestRelatedCount(t *testing.T) {
+	assert.Equal(t, defaultRelatedCount, relatedCount(ServerSection{}))
+	assert.Equal(t, 3, relatedCount(ServerSection{RelatedCount: 3}))
+	assert.Equal(t, 0, relatedCount(ServerSection{RelatedCount: -1}))
+}
+
+func TestRelatedQuery(t *testing.T) {
+	assert.Nil(t, relatedQuery(nil, nil, nil), "nothing to compare should give no query")
+	assert.NotNil(t, relatedQuery([]string{"linux"}, nil, nil))
+	assert.NotNil(t, relatedQuery(nil, nil, []string{"disk"}))
+}
+
+// changingIndex is an index that only counts its changes
+type changingIndex struct {
+	Index
+	changes uint64
+}
+
+func (i *changingIndex) Changes() uint64 {
+	return i.changes
+}
+
+func TestRelatedCache(t *testing.T) {
+	index := &changingIndex{}
+	cache := newRelatedCache()
+	var finds int
+	find := func() ([]RelatedPage, error) {
+		finds++
+		return []RelatedPage{{Title: "Memory", URIPath: "/memory"}}, nil
+	}
+
+	for count := 0; count < 3; count++ {
+		related, err := cache.get(index, "/disk.md", find)
+		assert.NoError(t, err)
+		assert.Equal(t, []RelatedPage{{Title: "Memory", URIPath: "/memory"}}, related)
+	}
+	assert.Equal(t, 1, finds, "the related pages should be cached")
+
+	cache.get(index, "/memory.md", find)
+	assert.Equal(t, 2, finds, "each page should be cached on its own")
+
+	index.changes++
+	cache.get(index, "/disk.md", find)
+	assert.Equal(t, 3, finds, "a change to the index should empty the cache")
+}
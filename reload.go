@@ -0,0 +1,165 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	fsnotify "gopkg.in/fsnotify.v1"
+)
+
+// how long to wait after the last change before reloading, so an editor
+//  writing several files does not trigger several reloads
+const reloadDelay = time.Second
+
+// Reloader rebuilds the config, templates, and muxer when the config file or
+//  templates change, or when a SIGHUP is recieved. If anything fails to load,
+//  the error is logged and the old config, templates, and muxer keep serving.
+type Reloader struct {
+	configFile string
+	handler    *SwappableHandler
+	indexes    *IndexSet
+	logs       *log.Logger
+	lock       sync.Mutex
+}
+
+// NewReloader sets up a Reloader that swaps the rebuilt muxer into handler
+func NewReloader(configFile string, handler *SwappableHandler,
+	indexes *IndexSet, logs *log.Logger) *Reloader {
+	return &Reloader{
+		configFile: configFile,
+		handler:    handler,
+		indexes:    indexes,
+		logs:       logs,
+	}
+}
+
+// Reload reads the config and templates, and rebuilds the muxer. Nothing is
+//  swapped in unless all of them load. Indexes that changed are only
+//  switched over, and unused ones closed, once the new muxer is serving.
+func (r *Reloader) Reload() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	config, err := ReadConfig(r.configFile)
+	if err != nil {
+		return err
+	}
+
+	templates, err := ReadTemplates(*config)
+	if err != nil {
+		return err
+	}
+
+	old := GetConfig()
+	handler, err := BuildHandler(*config, r.indexes, r.logs)
+	if err != nil {
+		// close anything opened for the new config
+		if old != nil {
+			r.indexes.Prune(old.Indexes)
+		}
+		return err
+	}
+
+	if old != nil && (old.Address != config.Address || old.Port != config.Port ||
+		old.CertFile != config.CertFile || old.KeyFile != config.KeyFile ||
+		old.RedirectPort != config.RedirectPort) {
+		r.logs.Println("listener settings changed, restart to apply them")
+	}
+
+	SetConfig(config)
+	SetTemplates(templates)
+	r.handler.Swap(handler)
+	r.indexes.Prune(config.Indexes)
+
+	r.logs.Printf("loaded config [%s]", r.configFile)
+	return nil
+}
+
+// watchPaths gives the directories to watch for the current config. The
+//  config file's directory is watched instead of the file, so that editors
+//  replacing the file are still noticed.
+func (r *Reloader) watchPaths() []string {
+	paths := []string{filepath.Dir(r.configFile)}
+	if config := GetConfig(); config != nil {
+		paths = append(paths, filepath.Clean(config.TemplateDir))
+	}
+	return paths
+}
+
+// isWatched checks if a changed file is the config file or a template
+func (r *Reloader) isWatched(name string) bool {
+	if filepath.Clean(name) == filepath.Clean(r.configFile) {
+		return true
+	}
+	config := GetConfig()
+	if config == nil {
+		return false
+	}
+	matched, err := filepath.Match(templateGlob(*config), filepath.Clean(name))
+	return err == nil && matched
+}
+
+// Watch reloads on changes and SIGHUP until closer is closed
+func (r *Reloader) Watch(closer <-chan struct{}) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return &Error{Code: ErrWatcherCreate, innerError: err}
+	}
+	defer watcher.Close()
+
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	defer signal.Stop(hupChan)
+
+	watching := make(map[string]bool)
+	updateWatches := func() {
+		current := make(map[string]bool)
+		for _, dir := range r.watchPaths() {
+			current[dir] = true
+			if watching[dir] {
+				continue
+			}
+			if err := watcher.Add(dir); err != nil {
+				r.logs.Println(&Error{Code: ErrWatcherAdd, value: dir, innerError: err})
+				continue
+			}
+			watching[dir] = true
+		}
+		for dir := range watching {
+			if !current[dir] {
+				watcher.Remove(dir)
+				delete(watching, dir)
+			}
+		}
+	}
+	updateWatches()
+
+	reloadTimer := time.NewTimer(reloadDelay)
+	reloadTimer.Stop()
+
+	for {
+		select {
+		case <-closer:
+			return nil
+		case <-hupChan:
+			r.logs.Println("recieved SIGHUP, reloading")
+			reloadTimer.Reset(0)
+		case event := <-watcher.Events:
+			if r.isWatched(event.Name) {
+				reloadTimer.Reset(reloadDelay)
+			}
+		case err := <-watcher.Errors:
+			r.logs.Println(&Error{Code: ErrWatcherError, innerError: err})
+		case <-reloadTimer.C:
+			if err := r.Reload(); err != nil {
+				r.logs.Printf("failed to reload, keeping the old config - %v", err)
+			}
+			updateWatches()
+		}
+	}
+}
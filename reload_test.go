@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReloaderWatchesTemplates(t *testing.T) {
+	root, err := ioutil.TempDir("", "reload.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	writeTestTree(t, root, map[string]string{
+		"templates/page.html": `{{define "page.html"}}page{{end}}`,
+		"goki.json":           "{}",
+		"other.html":          "not a template",
+	})
+
+	// the trailing slash is how the docs give it
+	config := &GlobalSection{TemplateDir: filepath.Join(root, "templates") + "/"}
+	CleanConfig(config)
+	old := GetConfig()
+	SetConfig(config)
+	defer SetConfig(old)
+
+	templates, err := ReadTemplates(*config)
+	if assert.NoError(t, err) {
+		assert.NotNil(t, templates.Lookup("page.html"))
+	}
+
+	r := NewReloader(filepath.Join(root, "goki.json"), nil, nil, log.New(ioutil.Discard, "", 0))
+	assert.Equal(t, []string{root, filepath.Join(root, "templates")}, r.watchPaths())
+
+	var tests = []struct {
+		name    string
+		watched bool
+	}{
+		{filepath.Join(root, "goki.json"), true},
+		{filepath.Join(root, "templates", "page.html"), true},
+		{filepath.Join(root, "templates", "new.html"), true},
+		{filepath.Join(root, "other.html"), false},
+		{filepath.Join(root, "templates-old", "page.html"), false},
+	}
+	for _, testSet := range tests {
+		assert.Equal(t, testSet.watched, r.isWatched(testSet.name), "[%s]", testSet.name)
+	}
+}
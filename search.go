@@ -1,8 +1,12 @@
 package main
 
 import (
+	"html/template"
 	"log"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 	"unicode"
@@ -14,17 +18,46 @@ import (
 // you probably want this for docs
 // http://localhost:6060/pkg/github.com/JackKnifed/goki/vendor/github.com/blevesearch/bleve/#NewConjunctionQuery
 
+// the page sizes used when a handler does not configure its own
+const (
+	defaultPageSize    = 10
+	defaultMaxPageSize = 100
+)
+
+// the most values ListField gives back for a field
+const listFieldSize = 1000
+
+// the deepest into the results a search may page
+const maxResultWindow = 10000
+
 // SearchResponse is the parent type structure that will come back to all
 //  requests. []Results will contain child results.
 type SearchResponse struct {
 	TotalHits  int
 	PageOffset int
+	Page       int    // the current page, counted from 1
+	PageSize   int    // the most results on each page
+	TotalPages int    // the number of pages of results
+	PrevPage   string // link to the previous page, or empty on the first
+	NextPage   string // link to the next page, or empty on the last
 	SearchTime time.Duration
 	Topics     []string
 	Authors    []string
+	Values     []string     // every value of a custom field being listed
+	Facets     SearchFacets // the results broken down by field
+	Sort       string       // the order of the results
+	Sorts      []SortOption // every order the results can be put in
 	Results    []SearchResponseResult
 }
 
+// SortOption is one order search results can be put in, with a link to the
+//  current search in that order
+type SortOption struct {
+	Value    string
+	Selected bool
+	Link     string
+}
+
 // SearchResponseResult is the child type that will come back to all responses
 type SearchResponseResult struct {
 	Title    string
@@ -33,30 +66,103 @@ type SearchResponseResult struct {
 	Topics   []string
 	Keywords []string
 	Authors  []string
-	Body     string
+	Modified time.Time // when the page was last changed
+	Body     string    // a plain snippet of the body around the matches
+	// the title and body snippet, escaped, with the matches in <mark> tags
+	TitleHTML template.HTML
+	Snippet   template.HTML
+	// highlighted pieces of each matched field, keyed by field name
+	Fragments map[string][]template.HTML
+}
+
+// SearchOptions are the settings every search shares - the filters to narrow
+//  it down with, the page to return, and how long each snippet may be.
+type SearchOptions struct {
+	SearchFilters
+	Page          int    `form:"page,omitempty"`
+	PageSize      int    `form:"pageSize,omitempty"`
+	SnippetLength int    `form:"-"`
+	Sort          string `form:"sort,omitempty"`
 }
 
+// the order results come back in if none is asked for - best match first
+const defaultSort = "-score"
+
+// sortFields are the fields results can be sorted on, and the field in the
+//  index each one sorts by
+var sortFields = map[string]string{
+	"score":    "_score",
+	"title":    "title_sort",
+	"modified": "modified",
+	"path":     "path_sort",
+}
+
+// sortOptions lists every valid sort, in the order they are offered
+var sortOptions = []string{
+	"-score", "score",
+	"title", "-title",
+	"-modified", "modified",
+	"path", "-path",
+}
+
+// validSort checks if a sort is one of the sortFields, with an optional -
+//  in front for descending order
+func validSort(sort string) bool {
+	_, ok := sortFields[strings.TrimPrefix(sort, "-")]
+	return ok
+}
+
+// sortOrder gives the bleve sort order for a sort, falling back to the
+//  default. Ties are broken by score, then by document.
+func sortOrder(sort string) []string {
+	if !validSort(sort) {
+		sort = defaultSort
+	}
+	order := sortFields[strings.TrimPrefix(sort, "-")]
+	if strings.HasPrefix(sort, "-") {
+		order = "-" + order
+	}
+	if order == "_score" || order == "-_score" {
+		return []string{order, "_id"}
+	}
+	return []string{order, "-_score", "_id"}
+}
+
+// resultFields are the stored fields a search asks for to fill in each of
+//  its SearchResponseResults
+var resultFields = []string{"path", "title", "topic", "keyword", "author", "modified", "body"}
+
 // CreateResponseData takes a search result, and produces a SearchResponse
 //  suitable for passing to a template.
-func CreateResponseData(i Index, results *bleve.SearchResult, pageOffset int) (
+func CreateResponseData(i Index, results *bleve.SearchResult, opts SearchOptions) (
 	SearchResponse, error) {
+	page, pageSize := opts.Page, opts.PageSize
+	if !validSort(opts.Sort) {
+		opts.Sort = defaultSort
+	}
 
-	topics, err := ListField(i, "topics")
+	visible := SearchFilters{Viewer: opts.Viewer}
+	topics, err := ListField(i, "topic", visible)
 	if err != nil {
 		return SearchResponse{}, err
 	}
 
-	authors, err := ListField(i, "authors")
+	authors, err := ListField(i, "author", visible)
 	if err != nil {
 		return SearchResponse{}, err
 	}
 
 	response := SearchResponse{
 		TotalHits:  int(results.Total),
-		PageOffset: pageOffset,
+		PageOffset: pageOffset(page, pageSize),
+		Page:       page,
+		PageSize:   pageSize,
 		SearchTime: results.Took,
 		Topics:     topics,
 		Authors:    authors,
+		Facets:     buildFacets(results),
+		Sort:       opts.Sort,
+		TotalPages: totalPages(int(results.Total), pageSize),
 	}
 
 	for _, hit := range results.Hits {
@@ -66,6 +172,15 @@ func CreateResponseData(i Index, results *bleve.SearchResult, pageOffset int) (
 		var newHit SearchResponseResult
 
 		newHit.Score = float64(hit.Score * 100 / results.MaxScore)
+		terms := fragmentTerms(hit.Fragments)
+		if len(hit.Fragments) > 0 {
+			newHit.Fragments = make(map[string][]template.HTML)
+			for field, fragments := range hit.Fragments {
+				for _, fragment := range fragments {
+					newHit.Fragments[field] = append(newHit.Fragments[field], safeFragment(fragment))
+				}
+			}
+		}
 
 		for _, field := range []string{
 			"title",
@@ -74,8 +189,22 @@ func CreateResponseData(i Index, results *bleve.SearchResult, pageOffset int) (
 			"topic",
 			"keyword",
 			"author",
+			"modified",
 		} {
 			if _, isThere := hit.Fields[field]; isThere {
+				// tags are stored as a list, which comes back as a string
+				//  when there is only one
+				switch field {
+				case "topic":
+					newHit.Topics = storedStrings(hit.Fields[field])
+					continue
+				case "keyword":
+					newHit.Keywords = storedStrings(hit.Fields[field])
+					continue
+				case "author":
+					newHit.Authors = storedStrings(hit.Fields[field])
+					continue
+				}
 				if str, ok := hit.Fields[field].(string); ok {
 					switch field {
 					case "title":
@@ -84,12 +213,14 @@ func CreateResponseData(i Index, results *bleve.SearchResult, pageOffset int) (
 						newHit.URIPath = str
 					case "body":
 						newHit.Body = str
-					case "topic":
-						newHit.Topics = strings.Split(str, " ")
-					case "keyword":
-						newHit.Keywords = strings.Split(str, " ")
-					case "author":
-						newHit.Authors = strings.Split(str, " ")
+					case "modified":
+						newHit.Modified, err = time.Parse(time.RFC3339, str)
+						if err != nil {
+							return SearchResponse{}, &Error{
+								Code:  ErrResultsFormatType,
+								path:  field,
+								value: str}
+						}
 					}
 				} else {
 					return SearchResponse{}, &Error{
@@ -100,15 +231,107 @@ func CreateResponseData(i Index, results *bleve.SearchResult, pageOffset int) (
 			}
 		}
 
+		newHit.Body, newHit.Snippet = snippet(newHit.Body, terms, opts.SnippetLength)
+		newHit.TitleHTML = highlightTerms(newHit.Title, terms)
+
 		response.Results = append(response.Results, newHit)
 	}
 	return response, nil
 }
 
-// ListField lists all unique values for that field in index
-func ListField(i Index, field string) ([]string, error) {
-	searchRequest := bleve.NewSearchRequest(bleve.NewMatchAllQuery())
-	facet := bleve.NewFacetRequest(field, 1)
+// pageOffset gives the number of results before a page counted from 1. It
+//  never goes below 0, or past the last page within maxResultWindow.
+func pageOffset(page, pageSize int) int {
+	if page < 1 || pageSize < 1 {
+		return 0
+	}
+	if page > lastPage(pageSize) {
+		page = lastPage(pageSize)
+	}
+	return (page - 1) * pageSize
+}
+
+// lastPage gives the last page of pageSize results within maxResultWindow
+func lastPage(pageSize int) int {
+	if pageSize < 1 || pageSize > maxResultWindow {
+		return 1
+	}
+	return maxResultWindow / pageSize
+}
+
+// totalPages gives the number of pages of pageSize results that can be
+//  reached - only the hits within maxResultWindow can be paged to
+func totalPages(hits, pageSize int) int {
+	if pageSize < 1 {
+		return 0
+	}
+	pages := (hits + pageSize - 1) / pageSize
+	if pages > lastPage(pageSize) {
+		pages = lastPage(pageSize)
+	}
+	return pages
+}
+
+// SetLinks fills in the page and facet links from the request's form values
+func (s *SearchResponse) SetLinks(form url.Values) {
+	s.SetPageLinks(form)
+	s.SetFacetLinks(form)
+	s.SetSortLinks(form)
+}
+
+// SetSortLinks fills in Sorts, linking to the current search in each order,
+//  starting back on the first page
+func (s *SearchResponse) SetSortLinks(form url.Values) {
+	s.Sorts = nil
+	for _, sort := range sortOptions {
+		values := url.Values{}
+		for key, value := range form {
+			if key != "page" {
+				values[key] = value
+			}
+		}
+		values.Set("sort", sort)
+		s.Sorts = append(s.Sorts, SortOption{
+			Value:    sort,
+			Selected: sort == s.Sort,
+			Link:     "?" + values.Encode(),
+		})
+	}
+}
+
+// SetPageLinks fills in PrevPage and NextPage, as links relative to the
+//  current page that repeat the given form values with a different page.
+func (s *SearchResponse) SetPageLinks(form url.Values) {
+	link := func(page int) string {
+		values := url.Values{}
+		for key, value := range form {
+			values[key] = value
+		}
+		values.Set("page", strconv.Itoa(page))
+		return "?" + values.Encode()
+	}
+
+	s.PrevPage, s.NextPage = "", ""
+	if s.Page > 1 {
+		prev := s.Page - 1
+		if prev > s.TotalPages {
+			prev = s.TotalPages
+		}
+		if prev > 0 {
+			s.PrevPage = link(prev)
+		}
+	}
+	if s.Page < s.TotalPages {
+		s.NextPage = link(s.Page + 1)
+	}
+}
+
+// ListField lists all unique values for that field in index, among the pages
+//  matching the filters
+func ListField(i Index, field string, f SearchFilters) ([]string, error) {
+	searchRequest := bleve.NewSearchRequest(filterQuery(bleve.NewMatchAllQuery(), f))
+	searchRequest.Size = 0
+	facet := bleve.NewFacetRequest(field, listFieldSize)
 	searchRequest.AddFacet("allValues", facet)
 
 	searchResult, err := i.Query(searchRequest)
@@ -123,7 +346,8 @@ func ListField(i Index, field string) ([]string, error) {
 	return results, nil
 }
 
-func ListAllField(i Index, field, match string, pageSize, page int) (
+// ListAllField lists the pages with the term match in the given field
+func ListAllField(i Index, field, match string, opts SearchOptions) (
 	SearchResponse, error) {
 
 	var rawResult *bleve.SearchResult
@@ -133,17 +357,19 @@ func ListAllField(i Index, field, match string, pageSize, page int) (
 	case "":
 		rawResult = &bleve.SearchResult{}
 	default:
+		for _, tagField := range termFacets {
+			if field == tagField {
+				match = normalizeTag(match)
+			}
+		}
 		query := bleve.NewTermQuery(match)
 		query.SetField(field)
-		searchRequest := bleve.NewSearchRequest(query)
-		searchRequest.Fields = []string{
-			"path",
-			"title",
-			"topic",
-			"author",
-			"modified",
-		}
-		searchRequest.Size = pageSize
+		searchRequest := bleve.NewSearchRequest(filterQuery(query, opts.SearchFilters))
+		searchRequest.Fields = resultFields
+		searchRequest.Size = opts.PageSize
+		searchRequest.From = pageOffset(opts.Page, opts.PageSize)
+		searchRequest.SortBy(sortOrder(opts.Sort))
+		addFacets(searchRequest)
 
 		rawResult, err = i.Query(searchRequest)
 		if err != nil {
@@ -151,7 +377,7 @@ func ListAllField(i Index, field, match string, pageSize, page int) (
 		}
 	}
 
-	result, err := CreateResponseData(i, rawResult, page*pageSize)
+	result, err := CreateResponseData(i, rawResult, opts)
 	if err != nil {
 		return SearchResponse{}, &Error{
 			Code:       ErrFormatSearchResponse,
@@ -162,88 +388,170 @@ func ListAllField(i Index, field, match string, pageSize, page int) (
 	return result, nil
 }
 
-//FuzzySearchValues gives a standard structure to decode and pass to FuzzySearch
+// FuzzySearchValues gives a standard structure to decode and pass to FuzzySearch
 type FuzzySearchValues struct {
-	Term     string   `form:"s,omitempty"`
-	Topics   []string `form:"topic,omitempty"`
-	Authors  []string `form:"author,omitempty"`
-	Page     int      `form:"page,omitempty"`
-	PageSize int      `form:"pageSize,omitempty"`
+	Term string `form:"s,omitempty"`
+	SearchOptions
+	// these come from the handler's config rather than the request
+	Boosts    map[string]float64 `form:"-"`
+	Fuzziness int                `form:"-"`
 }
 
-// FuzzySearch runs a fuzzy search with the given input parameters against
-//  the given query
-func FuzzySearch(i Index, v FuzzySearchValues) (SearchResponse, error) {
-	var disjunctionQuery, conjunctionQuery []blevequery.Query
-	for _, eachTopic := range v.Topics {
-		newQuery := bleve.NewTermQuery(eachTopic)
-		newQuery.SetField("topic")
-		disjunctionQuery = append(disjunctionQuery, newQuery)
+// defaultFuzzyBoosts are the fields a fuzzy search term is matched against,
+//  and how much a match in each counts, when the handler does not set its own.
+var defaultFuzzyBoosts = map[string]float64{
+	"title":   6,
+	"keyword": 5,
+	"path":    4,
+	"topic":   3,
+	"body":    2,
+	"author":  1,
+}
+
+const (
+	defaultFuzziness = 1
+	maxFuzziness     = 2 // bleve refuses anything higher
+	phraseBoost      = 2 // how much more a phrase match counts than a fuzzy one
+)
+
+// fuzzyBoosts lays a handler's boosts over the defaults. A boost of 0 or less
+//  leaves that field out of the search.
+func fuzzyBoosts(boosts map[string]float64) map[string]float64 {
+	merged := make(map[string]float64, len(defaultFuzzyBoosts))
+	for field, boost := range defaultFuzzyBoosts {
+		merged[field] = boost
 	}
-	for _, eachAuthor := range v.Authors {
-		newQuery := bleve.NewTermQuery(eachAuthor)
-		newQuery.SetField("author")
-		disjunctionQuery = append(disjunctionQuery, newQuery)
+	for field, boost := range boosts {
+		if boost <= 0 {
+			delete(merged, field)
+			continue
+		}
+		merged[field] = boost
 	}
+	return merged
+}
 
-	if v.Term != "" {
-		conjunctionQuery = append(conjunctionQuery, bleve.NewFuzzyQuery(v.Term))
+// searchWords splits a search term into lower case words, dropping
+//  punctuation and repeated words.
+func searchWords(term string) []string {
+	var words []string
+	seen := make(map[string]bool)
+	for _, word := range strings.FieldsFunc(strings.ToLower(term), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}) {
+		if !seen[word] {
+			seen[word] = true
+			words = append(words, word)
+		}
 	}
+	return words
+}
 
-	switch {
-	case len(disjunctionQuery) > 1:
-		conjunctionQuery = append(conjunctionQuery, bleve.NewDisjunctionQuery(disjunctionQuery...))
-		conjunctionQuery[len(conjunctionQuery)-1].(*blevequery.DisjunctionQuery).SetMin(1)
-	case len(disjunctionQuery) == 1:
-		conjunctionQuery = append(conjunctionQuery, disjunctionQuery[0])
+// isTagField reports if a field holds whole tags, which are not split into
+//  words when indexed.
+func isTagField(field string) bool {
+	for _, each := range termFacets {
+		if field == each {
+			return true
+		}
+	}
+	return false
+}
+
+// fuzzyTermQuery matches a search term against each field with that field's
+//  boost. The whole term is matched as a phrase, which counts for more, and
+//  each word is also matched on its own with the given fuzziness. Topics,
+//  keywords, and authors are matched against the whole term, normalized like
+//  a tag, exactly and with the given fuzziness. A negative fuzziness only
+//  matches the phrase or the exact tag. It returns nil if there is nothing to
+//  search for.
+func fuzzyTermQuery(term string, boosts map[string]float64, fuzziness int) blevequery.Query {
+	words := searchWords(term)
+	if len(words) == 0 {
+		return nil
 	}
+	tag := normalizeTag(term)
 
-	var query blevequery.Query
 	switch {
-	case len(conjunctionQuery) == 0:
-		query = bleve.NewMatchAllQuery()
-	case len(conjunctionQuery) == 1:
-		query = conjunctionQuery[0]
-	default:
-		query = bleve.NewConjunctionQuery(conjunctionQuery...)
+	case fuzziness == 0:
+		fuzziness = defaultFuzziness
+	case fuzziness > maxFuzziness:
+		fuzziness = maxFuzziness
+	}
+
+	var fields []string
+	for field := range boosts {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	var queries []blevequery.Query
+	for _, field := range fields {
+		if isTagField(field) {
+			exact := bleve.NewTermQuery(tag)
+			exact.SetField(field)
+			exact.SetBoost(boosts[field] * phraseBoost)
+			queries = append(queries, exact)
+
+			if fuzziness >= 0 {
+				fuzzy := bleve.NewFuzzyQuery(tag)
+				fuzzy.SetField(field)
+				fuzzy.SetBoost(boosts[field])
+				fuzzy.SetFuzziness(fuzziness)
+				queries = append(queries, fuzzy)
+			}
+			continue
+		}
+
+		phrase := bleve.NewMatchPhraseQuery(strings.Join(words, " "))
+		phrase.SetField(field)
+		phrase.SetBoost(boosts[field] * phraseBoost)
+		queries = append(queries, phrase)
+
+		if fuzziness < 0 {
+			continue
+		}
+		for _, word := range words {
+			fuzzy := bleve.NewFuzzyQuery(word)
+			fuzzy.SetField(field)
+			fuzzy.SetBoost(boosts[field])
+			fuzzy.SetFuzziness(fuzziness)
+			queries = append(queries, fuzzy)
+		}
+	}
+	if len(queries) == 0 {
+		return nil
 	}
 
-	searchRequest := bleve.NewSearchRequest(query)
-	searchRequest.Fields = []string{
-		"path",
-		"title",
-		"topic",
-		"author",
-		"modified",
-		"body",
+	query := bleve.NewDisjunctionQuery(queries...)
+	query.SetMin(1)
+	return query
+}
+
+// FuzzySearch runs a fuzzy search with the given input parameters against
+//  the given query
+func FuzzySearch(i Index, v FuzzySearchValues) (SearchResponse, error) {
+	var query blevequery.Query = bleve.NewMatchAllQuery()
+	if termQuery := fuzzyTermQuery(v.Term, fuzzyBoosts(v.Boosts), v.Fuzziness); termQuery != nil {
+		query = termQuery
 	}
+
+	searchRequest := bleve.NewSearchRequest(filterQuery(query, v.SearchFilters))
+	searchRequest.Fields = resultFields
 	searchRequest.Highlight = bleve.NewHighlight()
+	searchRequest.Highlight.AddField("title")
 	searchRequest.Highlight.AddField("body")
+	searchRequest.Size = v.PageSize
+	searchRequest.From = pageOffset(v.Page, v.PageSize)
+	searchRequest.SortBy(sortOrder(v.Sort))
+	addFacets(searchRequest)
 
 	rawResult, err := i.Query(searchRequest)
 	if err != nil {
 		return SearchResponse{}, &Error{Code: ErrInvalidQuery, innerError: err}
 	}
 
-	for id, each := range rawResult.Hits {
-		oldBody, ok := each.Fields["body"].(string)
-		if !ok {
-			continue
-		}
-		if len(oldBody) > 480 {
-			newBody := oldBody[:480]
-			for !unicode.IsSpace(rune(newBody[len(newBody)-1])) {
-				if len(newBody) < 100 {
-					break
-				}
-				newBody = newBody[:len(newBody)-2]
-			}
-			newBody += "..."
-			rawResult.Hits[id].Fields["body"] = newBody
-		}
-	}
-
-	searchResult, err := CreateResponseData(i, rawResult, v.Page)
+	searchResult, err := CreateResponseData(i, rawResult, v.SearchOptions)
 	if err != nil {
 		return SearchResponse{}, err
 	}
@@ -251,22 +559,48 @@ func FuzzySearch(i Index, v FuzzySearchValues) (SearchResponse, error) {
 	return searchResult, nil
 }
 
+// RecentChanges lists the pages in the index by when they were modified,
+//  newest first, narrowed down by the filters
+func RecentChanges(i Index, opts SearchOptions) (SearchResponse, error) {
+	opts.Sort = "-modified"
+
+	query := bleve.NewMatchAllQuery()
+	searchRequest := bleve.NewSearchRequest(filterQuery(query, opts.SearchFilters))
+	searchRequest.Fields = resultFields
+	searchRequest.Size = opts.PageSize
+	searchRequest.From = pageOffset(opts.Page, opts.PageSize)
+	searchRequest.SortBy(sortOrder(opts.Sort))
+	addFacets(searchRequest)
+
+	rawResult, err := i.Query(searchRequest)
+	if err != nil {
+		return SearchResponse{}, &Error{Code: ErrInvalidQuery, innerError: err}
+	}
+
+	return CreateResponseData(i, rawResult, opts)
+}
+
 // QuerySearch runs a given query search and returns a SearchResponse against
-//  the given index
-func QuerySearch(i Index, terms string, page, pageSize int) (
+//  the given index, narrowed down by the filters
+func QuerySearch(i Index, terms string, opts SearchOptions) (
 	SearchResponse, error) {
 	query := bleve.NewQueryStringQuery(terms)
-	searchRequest := bleve.NewSearchRequest(query)
-	searchRequest.Fields = []string{"path", "title", "topic", "author", "modified"}
-	searchRequest.Size = pageSize
-	searchRequest.From = pageSize * page
+	searchRequest := bleve.NewSearchRequest(filterQuery(query, opts.SearchFilters))
+	searchRequest.Fields = resultFields
+	searchRequest.Highlight = bleve.NewHighlight()
+	searchRequest.Highlight.AddField("title")
+	searchRequest.Highlight.AddField("body")
+	searchRequest.Size = opts.PageSize
+	searchRequest.From = pageOffset(opts.Page, opts.PageSize)
+	searchRequest.SortBy(sortOrder(opts.Sort))
+	addFacets(searchRequest)
 
 	rawResult, err := i.Query(searchRequest)
 	if err != nil {
 		return SearchResponse{}, err
 	}
 
-	searchResult, err := CreateResponseData(i, rawResult, page)
+	searchResult, err := CreateResponseData(i, rawResult, opts)
 	if err != nil {
 		return SearchResponse{}, err
 	}
@@ -274,16 +608,18 @@ func QuerySearch(i Index, terms string, page, pageSize int) (
 	return searchResult, nil
 }
 
-// FallbackSearchResponse is a function that writes a "bailout" template
-func FallbackSearchResponse(i Index, w http.ResponseWriter,
-	template string) {
-	authors, err := ListField(i, "author")
+// FallbackSearchResponse is a function that writes a "bailout" template, or
+//  the same data as json if the request asked for it. Only the pages
+//  matching the filters are listed.
+func FallbackSearchResponse(i Index, w http.ResponseWriter, r *http.Request,
+	template string, f SearchFilters) {
+	authors, err := ListField(i, "author", f)
 	if err != nil {
 		http.Error(w, "failed to list authors", http.StatusInternalServerError)
 		log.Println(err)
 		return
 	}
-	topics, err := ListField(i, "topic")
+	topics, err := ListField(i, "topic", f)
 	if err != nil {
 		http.Error(w, "failed to list topics", http.StatusInternalServerError)
 		log.Println(err)
@@ -292,11 +628,5 @@ func FallbackSearchResponse(i Index, w http.ResponseWriter,
 
 	fields := SearchResponse{Topics: topics, Authors: authors}
 
-	err = allTemplates.ExecuteTemplate(w, template, fields)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Println(err)
-		return
-	}
-	return
+	writeResponse(w, r, template, fields)
 }
@@ -2,6 +2,8 @@ package main
 
 import (
 	"io/ioutil"
+	"net/url"
+	"os"
 	"path/filepath"
 	"strings"
 	"testing"
@@ -9,6 +11,7 @@ import (
 
 	"github.com/blevesearch/bleve"
 	"github.com/blevesearch/bleve/search"
+	fsnotify "gopkg.in/fsnotify.v1"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -75,6 +78,119 @@ func TestCreateResponseData(t *testing.T) {
 	}
 }
 
+func TestSetPageLinks(t *testing.T) {
+	var tests = []struct {
+		page       int
+		totalPages int
+		prev       string
+		next       string
+	}{
+		{1, 1, "", ""},
+		{1, 3, "", "?page=2&s=disk"},
+		{2, 3, "?page=1&s=disk", "?page=3&s=disk"},
+		{3, 3, "?page=2&s=disk", ""},
+		{9, 3, "?page=3&s=disk", ""},
+		{1, 0, "", ""},
+	}
+
+	for _, testSet := range tests {
+		form := url.Values{"s": {"disk"}, "page": {"5"}}
+		response := SearchResponse{Page: testSet.page, TotalPages: testSet.totalPages}
+		response.SetPageLinks(form)
+		assert.Equal(t, testSet.prev, response.PrevPage,
+			"page %d of %d got the wrong previous link", testSet.page, testSet.totalPages)
+		assert.Equal(t, testSet.next, response.NextPage,
+			"page %d of %d got the wrong next link", testSet.page, testSet.totalPages)
+		assert.Equal(t, "5", form.Get("page"), "the given form should not change")
+	}
+}
+
+func TestTotalPages(t *testing.T) {
+	var tests = []struct {
+		hits, pageSize, expected int
+	}{
+		{0, 10, 0},
+		{1, 10, 1},
+		{20, 10, 2},
+		{21, 10, 3},
+		{5, 0, 0},
+		{maxResultWindow * 3, 10, maxResultWindow / 10},
+		{maxResultWindow * 3, 30, maxResultWindow / 30},
+	}
+	for _, testSet := range tests {
+		assert.Equal(t, testSet.expected, totalPages(testSet.hits, testSet.pageSize),
+			"%d hits, %d on a page", testSet.hits, testSet.pageSize)
+	}
+}
+
+func TestSearchWords(t *testing.T) {
+	var tests = []struct {
+		input  string
+		output []string
+	}{
+		{"", nil},
+		{"  ", nil},
+		{"disk", []string{"disk"}},
+		{"Disk Space", []string{"disk", "space"}},
+		{"ca-bundle, ssl!", []string{"ca", "bundle", "ssl"}},
+		{"disk DISK disk space", []string{"disk", "space"}},
+		{"Überblick über", []string{"überblick", "über"}},
+	}
+
+	for _, testSet := range tests {
+		assert.Equal(t, testSet.output, searchWords(testSet.input),
+			"[%q] was split wrong", testSet.input)
+	}
+}
+
+func TestFuzzyBoosts(t *testing.T) {
+	assert.Equal(t, defaultFuzzyBoosts, fuzzyBoosts(nil), "no boosts should give the defaults")
+
+	boosts := fuzzyBoosts(map[string]float64{"title": 10, "author": 0, "summary": 3})
+	assert.Equal(t, 10.0, boosts["title"], "a configured boost should replace the default")
+	assert.Equal(t, defaultFuzzyBoosts["body"], boosts["body"], "unconfigured fields keep the default")
+	assert.Equal(t, 3.0, boosts["summary"], "new fields should be added")
+	_, ok := boosts["author"]
+	assert.False(t, ok, "a boost of 0 should drop the field")
+	assert.Equal(t, 1.0, defaultFuzzyBoosts["author"], "the defaults should not change")
+}
+
+func TestSortOrder(t *testing.T) {
+	var tests = []struct {
+		sort  string
+		order []string
+	}{
+		{"", []string{"-_score", "_id"}},
+		{"nonsense", []string{"-_score", "_id"}},
+		{"score", []string{"_score", "_id"}},
+		{"-score", []string{"-_score", "_id"}},
+		{"title", []string{"title_sort", "-_score", "_id"}},
+		{"-modified", []string{"-modified", "-_score", "_id"}},
+		{"path", []string{"path_sort", "-_score", "_id"}},
+	}
+
+	for _, testSet := range tests {
+		assert.Equal(t, testSet.order, sortOrder(testSet.sort),
+			"[%q] gave the wrong order", testSet.sort)
+	}
+
+	for _, sort := range sortOptions {
+		assert.True(t, validSort(sort), "[%q] is offered but not valid", sort)
+	}
+}
+
+func TestSetSortLinks(t *testing.T) {
+	response := SearchResponse{Sort: "-modified"}
+	response.SetSortLinks(url.Values{"topic": {"linux"}, "page": {"4"}})
+
+	assert.Len(t, response.Sorts, len(sortOptions))
+	for _, option := range response.Sorts {
+		assert.Equal(t, option.Value == "-modified", option.Selected,
+			"[%q] was selected wrong", option.Value)
+		assert.Equal(t, "?sort="+url.QueryEscape(option.Value)+"&topic=linux", option.Link)
+	}
+}
+
 func TestGetURIPath(t *testing.T) {
 	var tests = []struct {
 		input  string
@@ -97,6 +213,67 @@ func TestGetURIPath(t *testing.T) {
 	}
 }
 
+func TestWatchRecursive(t *testing.T) {
+	root, err := ioutil.TempDir("", "watchRecursive.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	dirs := []string{
+		root,
+		filepath.Join(root, "a"),
+		filepath.Join(root, "a", "b"),
+		filepath.Join(root, "c"),
+	}
+	for _, dir := range dirs[1:] {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "a", "page.md"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+
+	i := &indexObject{}
+	watchedDirs := make(map[string]bool)
+	assert.NoError(t, i.watchRecursive(watcher, root, watchedDirs))
+	assert.Equal(t, len(dirs), len(watchedDirs), "watched the wrong number of dirs")
+	for _, dir := range dirs {
+		assert.True(t, watchedDirs[dir], "did not watch [%q]", dir)
+	}
+}
+
+func TestOwnsURI(t *testing.T) {
+	var tests = []struct {
+		uri      string
+		prefix   string
+		expected bool
+	}{
+		{"/page.md", "/", true},
+		{"/sub/page.md", "/", true},
+		{"/other/page.md", "/", false},
+		{"/other/page.md", "/other/", true},
+		{"/page.md", "/other/", false},
+		{"/otherpage.md", "/", true},
+	}
+	i := &indexObject{config: IndexSection{WatchDirs: map[string]string{
+		"/var/www/wiki/":  "/",
+		"/var/www/other/": "/other",
+	}}}
+
+	for _, testSet := range tests {
+		assert.Equal(t, testSet.expected, i.ownsURI(testSet.uri, testSet.prefix),
+			"[%q] under prefix [%q] was owned wrong", testSet.uri, testSet.prefix)
+	}
+}
+
 func TestCleanupMarkdownFiles(t *testing.T) {
 	var input string
 	defer func() {
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"html"
+	"html/template"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// the tags bleve's html highlighter wraps each matched term in
+const (
+	markOpen  = "<mark>"
+	markClose = "</mark>"
+)
+
+// the length of a snippet, in characters, when a handler does not set one
+const defaultSnippetLength = 480
+
+// match is the location of a matched term within a []rune
+type match struct {
+	start int
+	end   int
+}
+
+// splitFragment splits a fragment from bleve into its plain and marked
+//  pieces. Every odd piece was marked.
+func splitFragment(fragment string) []string {
+	var pieces []string
+	for {
+		open := strings.Index(fragment, markOpen)
+		if open < 0 {
+			break
+		}
+		closing := strings.Index(fragment[open:], markClose)
+		if closing < 0 {
+			break
+		}
+		pieces = append(pieces, fragment[:open], fragment[open+len(markOpen):open+closing])
+		fragment = fragment[open+closing+len(markClose):]
+	}
+	return append(pieces, fragment)
+}
+
+// safeFragment escapes a fragment from bleve, keeping only the mark tags
+func safeFragment(fragment string) template.HTML {
+	var out string
+	for id, piece := range splitFragment(fragment) {
+		piece = template.HTMLEscapeString(html.UnescapeString(piece))
+		if id%2 == 1 {
+			piece = markOpen + piece + markClose
+		}
+		out += piece
+	}
+	return template.HTML(out)
+}
+
+// fragmentTerms lists the lower case terms bleve marked in the fragments
+func fragmentTerms(fragments map[string][]string) []string {
+	var terms []string
+	seen := make(map[string]bool)
+	for _, list := range fragments {
+		for _, fragment := range list {
+			for id, piece := range splitFragment(fragment) {
+				term := strings.ToLower(html.UnescapeString(piece))
+				if id%2 == 1 && term != "" && !seen[term] {
+					seen[term] = true
+					terms = append(terms, term)
+				}
+			}
+		}
+	}
+	return terms
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r)
+}
+
+// findMatches finds each whole word occurrence of the terms in text, ignoring
+//  case. Overlapping matches are dropped.
+func findMatches(text []rune, terms []string) []match {
+	lower := make([]rune, len(text))
+	for id, r := range text {
+		lower[id] = unicode.ToLower(r)
+	}
+
+	var matches []match
+	for _, term := range terms {
+		termRunes := []rune(term)
+		if len(termRunes) == 0 {
+			continue
+		}
+		for start := 0; start+len(termRunes) <= len(lower); start++ {
+			end := start + len(termRunes)
+			if string(lower[start:end]) != term {
+				continue
+			}
+			if (start > 0 && isWordRune(lower[start-1])) || (end < len(lower) && isWordRune(lower[end])) {
+				continue
+			}
+			matches = append(matches, match{start: start, end: end})
+		}
+	}
+
+	sort.Slice(matches, func(a, b int) bool {
+		return matches[a].start < matches[b].start
+	})
+	var kept []match
+	for _, m := range matches {
+		if len(kept) > 0 && m.start < kept[len(kept)-1].end {
+			continue
+		}
+		kept = append(kept, m)
+	}
+	return kept
+}
+
+// snippetWindow picks the part of text, at most length runes long, holding
+//  the most matches, centered on a match. The ends are moved in to the
+//  nearest spaces so words are not cut - unless that would drop a match, or
+//  the text has no spaces to cut at.
+func snippetWindow(text []rune, matches []match, length int) (start, end int) {
+	if len(text) <= length {
+		return 0, len(text)
+	}
+
+	best := -1
+	for _, center := range matches {
+		s := (center.start+center.end)/2 - length/2
+		if s < 0 {
+			s = 0
+		}
+		if s > len(text)-length {
+			s = len(text) - length
+		}
+		count := 0
+		for _, m := range matches {
+			if m.start >= s && m.end <= s+length {
+				count++
+			}
+		}
+		if count > best {
+			best, start = count, s
+		}
+	}
+	end = start + length
+
+	// the first and last matches that fit, which the cuts must not pass
+	firstMatch, lastMatch := end, start
+	for _, m := range matches {
+		if m.start >= start && m.end <= end {
+			if m.start < firstMatch {
+				firstMatch = m.start
+			}
+			if m.end > lastMatch {
+				lastMatch = m.end
+			}
+		}
+	}
+
+	if start > 0 && !unicode.IsSpace(text[start-1]) {
+		for cut := start; cut < end && cut <= firstMatch; cut++ {
+			if unicode.IsSpace(text[cut]) {
+				start = cut + 1
+				break
+			}
+		}
+	}
+	if end < len(text) && !unicode.IsSpace(text[end]) {
+		for cut := end - 1; cut > start && cut >= lastMatch; cut-- {
+			if unicode.IsSpace(text[cut]) {
+				end = cut
+				break
+			}
+		}
+	}
+	return start, end
+}
+
+// highlight escapes text[start:end], wrapping each match in mark tags
+func highlight(text []rune, matches []match, start, end int) template.HTML {
+	var out string
+	at := start
+	for _, m := range matches {
+		if m.start < start || m.end > end {
+			continue
+		}
+		out += template.HTMLEscapeString(string(text[at:m.start]))
+		out += markOpen + template.HTMLEscapeString(string(text[m.start:m.end])) + markClose
+		at = m.end
+	}
+	return template.HTML(out + template.HTMLEscapeString(string(text[at:end])))
+}
+
+// highlightTerms escapes all of text, with the terms marked
+func highlightTerms(text string, terms []string) template.HTML {
+	runes := []rune(text)
+	return highlight(runes, findMatches(runes, terms), 0, len(runes))
+}
+
+// snippet cuts text down to at most length characters around the terms. It
+//  returns the plain snippet, and the same snippet escaped with the terms
+//  marked. Either end that was cut off gets "...".
+func snippet(text string, terms []string, length int) (string, template.HTML) {
+	if length <= 0 {
+		length = defaultSnippetLength
+	}
+	runes := []rune(strings.TrimSpace(text))
+	matches := findMatches(runes, terms)
+	start, end := snippetWindow(runes, matches, length)
+
+	plain := string(runes[start:end])
+	marked := highlight(runes, matches, start, end)
+	if start > 0 {
+		plain = "..." + plain
+		marked = "..." + marked
+	}
+	if end < len(runes) {
+		plain += "..."
+		marked += "..."
+	}
+	return plain, marked
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"html/template"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSafeFragment(t *testing.T) {
+	var tests = []struct {
+		input  string
+		output template.HTML
+	}{
+		{"plain text", "plain text"},
+		{"check <mark>disk</mark> usage", "check <mark>disk</mark> usage"},
+		{"<script>alert(1)</script> <mark>disk</mark>",
+			"&lt;script&gt;alert(1)&lt;/script&gt; <mark>disk</mark>"},
+		{"a &amp; b <mark>c</mark>", "a &amp; b <mark>c</mark>"},
+		{"<mark>open only", "&lt;mark&gt;open only"},
+	}
+
+	for _, testSet := range tests {
+		assert.Equal(t, testSet.output, safeFragment(testSet.input),
+			"[%q] was not escaped right", testSet.input)
+	}
+}
+
+func TestFragmentTerms(t *testing.T) {
+	terms := fragmentTerms(map[string][]string{
+		"body": {"check <mark>Disk</mark> and <mark>disk</mark> <mark>usage</mark>"},
+	})
+	assert.Equal(t, []string{"disk", "usage"}, terms)
+	assert.Nil(t, fragmentTerms(nil))
+}
+
+func TestFindMatches(t *testing.T) {
+	text := []rune("Disk usage: the disks and the disk.")
+	assert.Equal(t, []match{{0, 4}, {30, 34}}, findMatches(text, []string{"disk"}),
+		"should only match whole words, ignoring case")
+	assert.Equal(t, []match{{0, 4}, {5, 10}, {30, 34}},
+		findMatches(text, []string{"usage", "disk"}), "matches should be in order")
+
+	text = []rune("über Über")
+	assert.Equal(t, []match{{0, 4}, {5, 9}}, findMatches(text, []string{"über"}),
+		"should count runes, not bytes")
+}
+
+func TestSnippet(t *testing.T) {
+	plain, marked := snippet("short body", []string{"body"}, 100)
+	assert.Equal(t, "short body", plain)
+	assert.Equal(t, template.HTML("short <mark>body</mark>"), marked)
+
+	long := strings.Repeat("filler words here ", 30) + "the disk is full " +
+		strings.Repeat("more words after ", 30)
+	plain, marked = snippet(long, []string{"disk"}, 60)
+	assert.True(t, strings.HasPrefix(plain, "..."), "the start should be cut off")
+	assert.True(t, strings.HasSuffix(plain, "..."), "the end should be cut off")
+	assert.Contains(t, plain, "the disk is full")
+	assert.Contains(t, string(marked), "<mark>disk</mark>")
+	assert.True(t, utf8.RuneCountInString(plain) <= 66, "the snippet is too long")
+	for _, word := range strings.Fields(strings.Trim(plain, ".")) {
+		assert.Contains(t, long, " "+word+" ", "[%q] is not a whole word", word)
+	}
+
+	plain, _ = snippet(strings.Repeat("ü", 50), nil, 10)
+	assert.True(t, utf8.ValidString(plain), "should not split a rune")
+	assert.Equal(t, strings.Repeat("ü", 10)+"...", plain)
+
+	_, marked = snippet("<b>disk</b> & more", []string{"disk"}, 100)
+	assert.Equal(t, template.HTML("&lt;b&gt;<mark>disk</mark>&lt;/b&gt; &amp; more"), marked)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// certLoader hands the configured certificate to the TLS listener, and
+//  reloads it from disk whenever the cert or key file is modified. If the new
+//  pair fails to load, the old certificate keeps being served.
+type certLoader struct {
+	certFile string
+	keyFile  string
+	lock     sync.RWMutex
+	cert     *tls.Certificate
+	modTime  time.Time
+}
+
+func newCertLoader(certFile, keyFile string) (*certLoader, error) {
+	l := &certLoader{certFile: certFile, keyFile: keyFile}
+	if err := l.reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// latestModTime returns the newest modification time of the cert and key
+func (l *certLoader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{l.certFile, l.keyFile} {
+		stats, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, &Error{Code: ErrLoadCert, value: file, innerError: err}
+		}
+		if stats.ModTime().After(latest) {
+			latest = stats.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (l *certLoader) reload() error {
+	modTime, err := l.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return &Error{Code: ErrLoadCert, value: l.certFile, innerError: err}
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.cert = &cert
+	l.modTime = modTime
+	return nil
+}
+
+// GetCertificate is meant to be used as tls.Config.GetCertificate
+func (l *certLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.lock.RLock()
+	current := l.modTime
+	l.lock.RUnlock()
+
+	modTime, err := l.latestModTime()
+	if err == nil && modTime.After(current) {
+		if err = l.reload(); err == nil {
+			log.Printf("reloaded certificate [%s]", l.certFile)
+		}
+	}
+	if err != nil {
+		log.Println(err)
+	}
+
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.cert, nil
+}
+
+// redirectToHTTPS is a http.Handler that sends every request to the same
+//  host and path over https, on the given port.
+func redirectToHTTPS(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		target := url.URL{
+			Scheme:   "https",
+			Host:     host,
+			Path:     r.URL.Path,
+			RawQuery: r.URL.RawQuery,
+		}
+		http.Redirect(w, r, target.String(), http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedirectToHTTPS(t *testing.T) {
+	var tests = []struct {
+		port     string
+		request  string
+		expected string
+	}{
+		{"443", "http://localhost/", "https://localhost/"},
+		{"443", "http://localhost:8080/page?s=term", "https://localhost/page?s=term"},
+		{"8443", "http://localhost:8080/page", "https://localhost:8443/page"},
+		{"", "http://wiki.example.com/a/b", "https://wiki.example.com/a/b"},
+	}
+
+	for _, testSet := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", testSet.request, nil)
+		redirectToHTTPS(testSet.port).ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusMovedPermanently, w.Code,
+			"[%q] got the wrong response code", testSet.request)
+		assert.Equal(t, testSet.expected, w.Header().Get("Location"),
+			"[%q] redirected to the wrong location", testSet.request)
+	}
+}
+
+func TestNewCertLoaderMissing(t *testing.T) {
+	_, err := newCertLoader("./notafile.crt", "./notafile.key")
+	localError, ok := err.(*Error)
+	assert.True(t, ok, "did not get back my type of error")
+	assert.Equal(t, ErrLoadCert, localError.Code, "got the wrong error response")
+}
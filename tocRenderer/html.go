@@ -71,6 +71,10 @@ type HtmlRendererParameters struct {
 	HeaderIDPrefix string
 	// If set, add this text to the back of each Header ID, to ensure uniqueness.
 	HeaderIDSuffix string
+	// Resolves the title in a wiki link to the link it goes to. If found is
+	// false there is no page with that title, and link should go somewhere to
+	// look for it. If not set, wiki links are written out as plain text.
+	WikiLinkResolver func(title string) (link string, found bool)
 }
 
 // Html is a type that implements the Renderer interface for HTML output.
@@ -597,6 +601,24 @@ func (options *Html) Link(out *bytes.Buffer, link []byte, title []byte, content
 	return
 }
 
+func (options *Html) WikiLink(out *bytes.Buffer, title []byte, content []byte) {
+	if options.parameters.WikiLinkResolver == nil || options.flags&HTML_SKIP_LINKS != 0 {
+		attrEscape(out, content)
+		return
+	}
+
+	link, found := options.parameters.WikiLinkResolver(string(title))
+	if found {
+		out.WriteString("<a class=\"wiki-link\" href=\"")
+	} else {
+		out.WriteString("<a class=\"wiki-link missing\" href=\"")
+	}
+	attrEscape(out, []byte(link))
+	out.WriteString("\">")
+	attrEscape(out, content)
+	out.WriteString("</a>")
+}
+
 func (options *Html) RawHtmlTag(out *bytes.Buffer, text []byte) {
 	if options.flags&HTML_SKIP_HTML != 0 {
 		return
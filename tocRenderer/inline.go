@@ -198,6 +198,13 @@ func link(p *parser, out *bytes.Buffer, data []byte, offset int) int {
 		return 0
 	}
 
+	// [[title]] or [[title|label]] == wiki link
+	if p.flags&EXTENSION_WIKI_LINKS != 0 && !p.insideLink && (offset == 0 || data[offset-1] != '!') {
+		if consumed := wikiLink(p, out, data[offset:]); consumed > 0 {
+			return consumed
+		}
+	}
+
 	// [text] == regular link
 	// ![alt] == image
 	// ^[text] == inline footnote
@@ -547,6 +554,38 @@ func link(p *parser, out *bytes.Buffer, data []byte, offset int) int {
 	return i
 }
 
+// '[[': parse a wiki link, which goes to a page by its title rather than
+// by its path. The title and label are given to the renderer as they are.
+func wikiLink(p *parser, out *bytes.Buffer, data []byte) int {
+	if len(data) < 4 || data[0] != '[' || data[1] != '[' {
+		return 0
+	}
+	end := bytes.Index(data[2:], []byte("]]"))
+	if end < 0 {
+		return 0
+	}
+	inner := data[2 : 2+end]
+	if bytes.ContainsAny(inner, "[]\n") {
+		return 0
+	}
+
+	title, label := inner, inner
+	if pipe := bytes.IndexByte(inner, '|'); pipe >= 0 {
+		title, label = inner[:pipe], inner[pipe+1:]
+	}
+	title = bytes.TrimSpace(title)
+	label = bytes.TrimSpace(label)
+	if len(title) == 0 {
+		return 0
+	}
+	if len(label) == 0 {
+		label = title
+	}
+
+	p.r.WikiLink(out, title, label)
+	return end + 4
+}
+
 // '<' when tags or autolinks are allowed
 func leftAngle(p *parser, out *bytes.Buffer, data []byte, offset int) int {
 	data = data[offset:]
@@ -245,6 +245,10 @@ func (options *Latex) Link(out *bytes.Buffer, link []byte, title []byte, content
 	out.WriteString("}")
 }
 
+func (options *Latex) WikiLink(out *bytes.Buffer, title []byte, content []byte) {
+	out.Write(content)
+}
+
 func (options *Latex) RawHtmlTag(out *bytes.Buffer, tag []byte) {
 }
 
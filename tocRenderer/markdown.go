@@ -46,6 +46,7 @@ const (
 	EXTENSION_BACKSLASH_LINE_BREAK                   // translate trailing backslashes into line breaks
 	EXTENSION_DEFINITION_LISTS                       // render definition lists
 	EXTENSION_ALERT_BOXES                            // Create Alert boxes when encountered
+	EXTENSION_WIKI_LINKS                             // link pages by title with [[Title]] or [[Title|label]]
 
 	commonHtmlFlags = 0 |
 		HTML_USE_XHTML |
@@ -180,6 +181,7 @@ type Renderer interface {
 	Image(out *bytes.Buffer, link []byte, title []byte, alt []byte)
 	LineBreak(out *bytes.Buffer)
 	Link(out *bytes.Buffer, link []byte, title []byte, content []byte)
+	WikiLink(out *bytes.Buffer, title []byte, content []byte)
 	RawHtmlTag(out *bytes.Buffer, tag []byte)
 	TripleEmphasis(out *bytes.Buffer, text []byte)
 	StrikeThrough(out *bytes.Buffer, text []byte)